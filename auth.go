@@ -0,0 +1,41 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// proxyAuthRealm is the realm of the Basic challenge sent to the clients.
+const proxyAuthRealm = "yves"
+
+// authenticate checks the credentials in the Proxy-Authorization header of
+// req with RequireAuth. The header is removed so that neither the handlers
+// nor the remote host ever see it.
+func (p *Proxy) authenticate(req *http.Request) bool {
+	if p.RequireAuth == nil {
+		return true
+	}
+	// BasicAuth parses the Authorization header only
+	auth := &http.Request{Header: http.Header{"Authorization": {req.Header.Get("Proxy-Authorization")}}}
+	req.Header.Del("Proxy-Authorization")
+	user, pass, ok := auth.BasicAuth()
+	return ok && p.RequireAuth(user, pass)
+}
+
+// proxyAuthRequired asks the client to authenticate.
+func proxyAuthRequired(conn io.Writer) {
+	body := http.StatusText(http.StatusProxyAuthRequired)
+	rsp := &http.Response{
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    http.StatusProxyAuthRequired,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	rsp.Header.Set("Proxy-Authenticate", `Basic realm="`+proxyAuthRealm+`"`)
+	rsp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	rsp.Write(conn)
+}
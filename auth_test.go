@@ -0,0 +1,73 @@
+package yves
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(upstream.Config.Handler)
+	defer tlsUpstream.Close()
+
+	p := NewProxy()
+	p.RequireAuth = func(user, pass string) bool {
+		return user == "user" && pass == "secret"
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	testCases := []struct {
+		userinfo *url.Userinfo
+		allowed  bool
+	}{
+		{nil, false},
+		{url.UserPassword("user", "wrong"), false},
+		{url.UserPassword("user", "secret"), true},
+	}
+	for _, tc := range testCases {
+		proxyUrl, _ := url.Parse(proxyServer.URL)
+		proxyUrl.User = tc.userinfo
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if tc.allowed {
+			if resp.StatusCode != http.StatusOK || len(body) != 0 {
+				t.Errorf("Expected: 200 without Proxy-Authorization, but got: %d %s", resp.StatusCode, body)
+			}
+		} else {
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Errorf("Expected: %d, but got: %d", http.StatusProxyAuthRequired, resp.StatusCode)
+			}
+			if resp.Header.Get("Proxy-Authenticate") != `Basic realm="yves"` {
+				t.Errorf("Expected a Basic challenge, but got: %q", resp.Header.Get("Proxy-Authenticate"))
+			}
+		}
+
+		resp, err = client.Get(tlsUpstream.URL)
+		if tc.allowed {
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		} else if err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+			t.Errorf("Expected the CONNECT to be refused, but got: %v", err)
+		}
+	}
+}
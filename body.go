@@ -0,0 +1,371 @@
+package yves
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxBodyBufferSize is the maximum size of a body that is buffered in
+// memory to be handed to HandleRequestBody and HandleResponseBody.
+const DefaultMaxBodyBufferSize = 10 << 20
+
+// bufferBody reads up to limit bytes of body. If the whole body fits, it is
+// returned along with true. Otherwise the returned reader replays what has
+// already been read followed by the rest of the body, so that it can be
+// forwarded untouched.
+func bufferBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool, error) {
+	if body == nil || body == http.NoBody {
+		return []byte{}, body, true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, readCloser{io.MultiReader(bytes.NewReader(buf), body), body}, false, nil
+	}
+	body.Close()
+	return buf, nil, true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setBody replaces the body of a request or response, fixing the headers
+// that describe its length.
+func setBody(header http.Header, body []byte) (io.ReadCloser, int64) {
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if len(body) == 0 {
+		return http.NoBody, 0
+	}
+	return io.NopCloser(bytes.NewReader(body)), int64(len(body))
+}
+
+// digestHeaders are computed from the body, they become wrong when the
+// body is replaced. Only Content-MD5 is computed again, the others may use
+// any algorithm and are removed.
+var digestHeaders = []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"}
+
+// fixBodyHeaders fixes the headers computed from the body after it has
+// been replaced with body: Content-MD5 and ETag are computed again if they
+// were there, so that the clients neither reject the new body nor cache it
+// as the old one.
+func fixBodyHeaders(header http.Header, body []byte) {
+	hadMD5 := header.Get("Content-MD5") != ""
+	removeDigests(header)
+	if hadMD5 {
+		sum := md5.Sum(body)
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	if header.Get("ETag") != "" {
+		sum := sha256.Sum256(body)
+		header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+}
+
+// dropBodyHeaders removes the headers computed from the body after it has
+// been replaced with a body that is not known in advance.
+func dropBodyHeaders(header http.Header) {
+	removeDigests(header)
+	header.Del("ETag")
+}
+
+func removeDigests(header http.Header) {
+	for _, h := range digestHeaders {
+		header.Del(h)
+	}
+}
+
+// ErrRequestBodyTooLarge is returned when the body of a request is bigger
+// than MaxRequestBodySize, the client gets a 413.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// limitRequestBody rejects req if its body is known to be bigger than
+// MaxRequestBodySize, otherwise the body fails with ErrRequestBodyTooLarge
+// once the limit is exceeded, whoever is reading it.
+func (p *Proxy) limitRequestBody(req *http.Request) error {
+	if p.MaxRequestBodySize <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.ContentLength > p.MaxRequestBodySize {
+		return ErrRequestBodyTooLarge
+	}
+	req.Body = &limitedBody{ReadCloser: req.Body, remaining: p.MaxRequestBodySize}
+	return nil
+}
+
+// limitedBody is a body failing with ErrRequestBodyTooLarge after remaining
+// bytes, unlike io.LimitReader which would silently truncate it.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.remaining == 0 {
+		// the body must end here
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			b.err = ErrRequestBodyTooLarge
+			return 0, b.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// maxDiscardedBody is the maximum size of what is left of a request body
+// that is read to reuse the connection with the client, like net/http does.
+const maxDiscardedBody = 256 << 10
+
+// discardBody reads what is left of body, a request body read from the
+// connection with the client, and tells whether the next request can be
+// read from the connection.
+func discardBody(body io.Reader) bool {
+	if body == nil || body == http.NoBody {
+		return true
+	}
+	_, err := io.CopyN(io.Discard, body, maxDiscardedBody+1)
+	// the transport closes the bodies it sends, which reads them entirely
+	return err == io.EOF || errors.Is(err, http.ErrBodyReadAfterClose)
+}
+
+func (p *Proxy) maxBodyBufferSize() int64 {
+	if p.MaxBodyBufferSize > 0 {
+		return p.MaxBodyBufferSize
+	}
+	return DefaultMaxBodyBufferSize
+}
+
+// handleRequestBody buffers the request body and gives it to
+// HandleRequestBody, then applies the body rules.
+func (p *Proxy) handleRequestBody(session int64, req *http.Request) error {
+	rules := p.matchingRules(RuleRequest, RuleBody, req.URL.Host)
+	if p.HandleRequestBody == nil && len(rules) == 0 {
+		return nil
+	}
+	body, rest, ok, err := bufferBody(req.Body, p.maxBodyBufferSize())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// too big, forward it untouched
+		req.Body = rest
+		return nil
+	}
+	var newBody []byte
+	if p.HandleRequestBody != nil {
+		newBody = p.HandleRequestBody(session, req, body)
+	}
+	newBody = applyRules(rules, body, newBody)
+	if newBody == nil || bytes.Equal(newBody, body) {
+		// unchanged, only rewind the body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) == 0 {
+			req.Body = http.NoBody
+		}
+		return nil
+	}
+	req.Body, req.ContentLength = setBody(req.Header, newBody)
+	req.TransferEncoding = nil
+	fixBodyHeaders(req.Header, newBody)
+	return nil
+}
+
+// fixResponseLength fixes the length of resp after the handlers replaced
+// its body, orig. The new body gets its Content-Length if it fits in
+// MaxBodyBufferSize, otherwise, or if it is streamed, it is sent chunked
+// without ETag and digests. The responses to HEAD requests are left alone.
+func (p *Proxy) fixResponseLength(resp *http.Response, orig io.ReadCloser, streaming bool) error {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if orig != nil && orig != http.NoBody {
+		if resp.Body == nil || resp.Body == http.NoBody {
+			orig.Close()
+		} else {
+			resp.Body = replacedBody{ReadCloser: resp.Body, orig: orig}
+		}
+	}
+	if !streaming {
+		body, rest, ok, err := bufferBody(resp.Body, p.maxBodyBufferSize())
+		if err != nil {
+			return err
+		}
+		if ok {
+			resp.Body, resp.ContentLength = setBody(resp.Header, body)
+			resp.TransferEncoding = nil
+			fixBodyHeaders(resp.Header, body)
+			return nil
+		}
+		resp.Body = rest
+	}
+	dropBodyHeaders(resp.Header)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	return nil
+}
+
+// recordRequestBody makes the body of received, the copy of req given to
+// HandleResponse, replay what is read from the body of req when it is
+// forwarded, up to MaxBodyBufferSize. Nothing is recorded without
+// HandleResponse.
+func (p *Proxy) recordRequestBody(req, received *http.Request) {
+	if p.HandleResponse == nil || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	rec := &bodyRecorder{limit: p.maxBodyBufferSize()}
+	req.Body = readCloser{io.TeeReader(req.Body, rec), req.Body}
+	received.Body = io.NopCloser(&lazyReader{get: rec.recorded})
+	received.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(rec.recorded())), nil
+	}
+}
+
+// bodyRecorder keeps the first limit bytes written to it. It is written by
+// the transport while the handlers may read it.
+type bodyRecorder struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int64
+}
+
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rest := r.limit - int64(len(r.buf)); rest > 0 {
+		if int64(len(p)) > rest {
+			r.buf = append(r.buf, p[:rest]...)
+		} else {
+			r.buf = append(r.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (r *bodyRecorder) recorded() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf[:len(r.buf):len(r.buf)]
+}
+
+// lazyReader reads what get returns at the time of the first read.
+type lazyReader struct {
+	get func() []byte
+	r   *bytes.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		l.r = bytes.NewReader(l.get())
+	}
+	return l.r.Read(p)
+}
+
+// replacedBody closes the original body of a response along with the one
+// that replaced it, which may not have read it.
+type replacedBody struct {
+	io.ReadCloser
+	orig io.Closer
+}
+
+func (b replacedBody) Close() error {
+	b.orig.Close()
+	return b.ReadCloser.Close()
+}
+
+// sameBody tells whether a is still b, the body of a response before the
+// handlers ran. The proxy sets the bodies as pointers, a *cancelBody or a
+// *decodedBody once decoded, which are compared as such. Any other body is
+// considered different.
+func sameBody(a, b io.ReadCloser) bool {
+	switch b := b.(type) {
+	case *cancelBody:
+		return a == b
+	case *decodedBody:
+		return a == b
+	}
+	return false
+}
+
+// handleResponseBody buffers the response body and gives it to
+// HandleResponseBody, then applies the body rules.
+func (p *Proxy) handleResponseBody(session int64, resp *http.Response) error {
+	var rules []*MatchReplaceRule
+	if resp.Request != nil {
+		rules = p.matchingRules(RuleResponse, RuleBody, resp.Request.URL.Host)
+	}
+	if p.HandleResponseBody == nil && len(rules) == 0 {
+		return nil
+	}
+	body, rest, ok, err := bufferBody(resp.Body, p.maxBodyBufferSize())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// too big, forward it untouched
+		resp.Body = rest
+		return nil
+	}
+	var newBody []byte
+	if p.HandleResponseBody != nil {
+		newBody = p.HandleResponseBody(session, resp, body)
+	}
+	newBody = applyRules(rules, body, newBody)
+	if newBody == nil || bytes.Equal(newBody, body) {
+		// unchanged, only rewind the body
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+	resp.Body, resp.ContentLength = setBody(resp.Header, newBody)
+	resp.TransferEncoding = nil
+	fixBodyHeaders(resp.Header, newBody)
+	return nil
+}
+
+// applyRules applies rules to newBody, the body returned by a handler, or
+// to body when the handler returned nil. nil is returned if no rule matches.
+func applyRules(rules []*MatchReplaceRule, body, newBody []byte) []byte {
+	if len(rules) == 0 {
+		return newBody
+	}
+	if newBody == nil {
+		newBody = body
+	}
+	for _, rule := range rules {
+		newBody = rule.re.ReplaceAll(newBody, []byte(rule.Replace))
+	}
+	return newBody
+}
+
+// isStreaming tells whether the body of resp has to be streamed to the client.
+func (p *Proxy) isStreaming(session int64, resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	return p.StreamResponse != nil && p.StreamResponse(session, resp)
+}
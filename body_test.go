@@ -0,0 +1,427 @@
+package yves
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleResponseBody(t *testing.T) {
+	p := NewProxy()
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		return bytes.ReplaceAll(body, []byte("world"), []byte("yves!"))
+	}
+
+	resp := &http.Response{
+		Header:           http.Header{},
+		Body:             io.NopCloser(strings.NewReader("hello world")),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+	}
+	if err := p.handleResponseBody(0, resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello yves!" {
+		t.Errorf("Expected modified body, but got %q", body)
+	}
+	if resp.ContentLength != int64(len(body)) || resp.TransferEncoding != nil {
+		t.Errorf("Expected Content-Length %d, but got %d %v", len(body), resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+func TestHandleResponseBodyUnchanged(t *testing.T) {
+	p := NewProxy()
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		return body
+	}
+	resp := &http.Response{
+		Header:           http.Header{},
+		Body:             io.NopCloser(strings.NewReader("hello world")),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+	}
+	if err := p.handleResponseBody(0, resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Expected original body, but got %q", body)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) != 1 {
+		t.Errorf("Expected the response to be left chunked")
+	}
+}
+
+func TestBodyHeadersFixed(t *testing.T) {
+	p := NewProxy()
+	p.MaxBodyBufferSize = 16
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		return bytes.ReplaceAll(body, []byte("world"), []byte("yves!"))
+	}
+	header := func() http.Header {
+		return http.Header{
+			"Etag":        {`"v1"`},
+			"Content-Md5": {"XrY7u+Ae7tCTyyK7j1rNww=="},
+			"Digest":      {"sha-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="},
+		}
+	}
+
+	// the new body is known, the headers are computed again
+	resp := &http.Response{Header: header(), Body: io.NopCloser(strings.NewReader("hello world"))}
+	if err := p.handleResponseBody(0, resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-MD5"); got != "FoC2E2uLvn9zpxakoo498A==" {
+		t.Errorf("Expected the MD5 of the new body, but got: %q", got)
+	}
+	if got := resp.Header.Get("ETag"); got == `"v1"` || !strings.HasPrefix(got, `"`) {
+		t.Errorf("Expected a new ETag, but got: %q", got)
+	}
+	if got := resp.Header.Get("Digest"); got != "" {
+		t.Errorf("Expected the digest to be removed, but got: %q", got)
+	}
+
+	// an unchanged body keeps them
+	unchanged := &http.Response{Header: header(), Body: io.NopCloser(strings.NewReader("hello"))}
+	if err := p.handleResponseBody(0, unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if h := header(); unchanged.Header.Get("ETag") != h.Get("ETag") || unchanged.Header.Get("Content-MD5") != h.Get("Content-MD5") {
+		t.Errorf("Expected the headers to be left alone, but got: %v", unchanged.Header)
+	}
+
+	// a body too big to be buffered is sent without them
+	orig := io.NopCloser(strings.NewReader("hello"))
+	big := &http.Response{Header: header(), Body: io.NopCloser(strings.NewReader("hello world, and more"))}
+	if err := p.fixResponseLength(big, orig, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"ETag", "Content-MD5", "Digest"} {
+		if got := big.Header.Get(h); got != "" {
+			t.Errorf("Expected %s to be removed, but got: %q", h, got)
+		}
+	}
+}
+
+func TestHandleRequestBodyTooBig(t *testing.T) {
+	p := NewProxy()
+	p.MaxBodyBufferSize = 4
+	called := false
+	p.HandleRequestBody = func(id int64, req *http.Request, body []byte) []byte {
+		called = true
+		return body
+	}
+	req, _ := http.NewRequest("POST", "http://example.com", strings.NewReader("hello world"))
+	if err := p.handleRequestBody(0, req); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Errorf("Expected the handler not to be called for a big body")
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Expected original body, but got %q", body)
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	var received int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		atomic.StoreInt64(&received, int64(len(body)))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.MaxRequestBodySize = 10
+
+	var tests = []struct {
+		size        int
+		chunked     bool
+		bodyHandler bool
+		expected    int
+	}{
+		{10, false, false, http.StatusOK},
+		{10, true, false, http.StatusOK},
+		{11, false, false, http.StatusRequestEntityTooLarge},
+		{1 << 20, true, false, http.StatusRequestEntityTooLarge},
+		{1 << 20, true, true, http.StatusRequestEntityTooLarge},
+		{10, true, true, http.StatusOK},
+	}
+	for _, upstream := range []*httptest.Server{plain, secure} {
+		for _, tc := range tests {
+			handled := false
+			p.HandleRequestBody = nil
+			if tc.bodyHandler {
+				p.HandleRequestBody = func(id int64, req *http.Request, body []byte) []byte {
+					handled = true
+					return nil
+				}
+			}
+			atomic.StoreInt64(&received, -1)
+			var body io.Reader = bytes.NewReader(bytes.Repeat([]byte("a"), tc.size))
+			if tc.chunked {
+				// hide the length
+				body = io.MultiReader(body)
+			}
+			resp, err := client.Post(upstream.URL, "text/plain", body)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Errorf("Expected: %d, but got: %d (%s, size %d, chunked %v)", tc.expected, resp.StatusCode, upstream.URL, tc.size, tc.chunked)
+			}
+			if tc.expected == http.StatusOK && atomic.LoadInt64(&received) != int64(tc.size) {
+				t.Errorf("Expected: %d, but got: %d", tc.size, atomic.LoadInt64(&received))
+			}
+			if tc.bodyHandler && handled != (tc.expected == http.StatusOK) {
+				t.Errorf("Expected the body handler to be called only for small bodies, but got: %v", handled)
+			}
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+func TestChunkedRequestBodyStreamed(t *testing.T) {
+	first := []byte("first chunk")
+	rest := bytes.Repeat([]byte("0123456789"), 100000)
+	firstReceived := make(chan struct{})
+	received := make(chan []byte, 1)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("Expected: chunked, but got: %v", r.TransferEncoding)
+		}
+		buf := make([]byte, len(first))
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			t.Errorf("Cannot read the first chunk: %v", err)
+		}
+		close(firstReceived)
+		body, _ := io.ReadAll(r.Body)
+		received <- append(buf, body...)
+	}))
+	defer upstream.Close()
+
+	_, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(first)
+		// the rest is only sent once the upstream got the first chunk,
+		// which would never happen if the proxy buffered the body
+		select {
+		case <-firstReceived:
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(errors.New("the first chunk was not streamed"))
+			return
+		}
+		pw.Write(rest)
+		pw.Close()
+	}()
+	resp, err := client.Post(upstream.URL, "application/octet-stream", pr)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if body := <-received; !bytes.Equal(body, append(first, rest...)) {
+		t.Errorf("Expected: %d bytes, but got: %d", len(first)+len(rest), len(body))
+	}
+}
+
+func TestHandleResponseReplacesBody(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello world")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.MaxBodyBufferSize = 16
+	var newBody func(body io.ReadCloser) io.ReadCloser
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		// the length is left as it was
+		resp.Body = newBody(resp.Body)
+	}
+
+	var tests = []struct {
+		name     string
+		newBody  func(body io.ReadCloser) io.ReadCloser
+		expected string
+		length   int64
+	}{
+		// bigger than MaxBodyBufferSize, it is sent chunked
+		{"Longer", func(body io.ReadCloser) io.ReadCloser {
+			return io.NopCloser(strings.NewReader("hello world, and more"))
+		}, "hello world, and more", -1},
+		{"Shorter", func(body io.ReadCloser) io.ReadCloser {
+			return io.NopCloser(strings.NewReader("hi"))
+		}, "hi", 2},
+		{"Empty", func(body io.ReadCloser) io.ReadCloser {
+			return nil
+		}, "", 0},
+		{"Wrapped", func(body io.ReadCloser) io.ReadCloser {
+			return readCloser{io.MultiReader(strings.NewReader("> "), body), body}
+		}, "> hello world", 13},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newBody = tc.newBody
+			resp, err := client.Get(upstream.URL)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != tc.expected {
+				t.Errorf("Expected: %q, but got: %q (%v)", tc.expected, body, err)
+			}
+			if resp.ContentLength != tc.length {
+				t.Errorf("Expected: %d, but got: %d", tc.length, resp.ContentLength)
+			}
+		})
+	}
+}
+
+func TestHandleResponseReplacesStreamedBody(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Length", "12")
+		io.WriteString(w, "data: hello\n")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		resp.Body = readCloser{io.MultiReader(resp.Body, strings.NewReader("data: world\n")), resp.Body}
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "data: hello\ndata: world\n" {
+		t.Errorf("Expected: both events, but got: %q", body)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("Expected: -1, but got: %d", resp.ContentLength)
+	}
+}
+
+func TestHandleResponseKeepsBody(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, " world")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		resp.Header.Set("X-Handled", "yes")
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello world" {
+		t.Errorf("Expected: hello world, but got: %q", body)
+	}
+	// the body is not buffered when it has not been replaced
+	if resp.ContentLength != -1 {
+		t.Errorf("Expected: -1, but got: %d", resp.ContentLength)
+	}
+}
+
+func TestSameBody(t *testing.T) {
+	body := &cancelBody{ReadCloser: io.NopCloser(strings.NewReader("hello")), cancel: func() {}}
+	decoded := &decodedBody{ReadCloser: body, body: body}
+	other := io.NopCloser(strings.NewReader("hello"))
+	uncomparable := cancelBody{ReadCloser: other, cancel: func() {}}
+	var tests = []struct {
+		a, b     io.ReadCloser
+		expected bool
+	}{
+		{body, body, true},
+		{decoded, decoded, true},
+		{body, nil, false},
+		{nil, body, false},
+		{decoded, body, false},
+		{body, &cancelBody{ReadCloser: body.ReadCloser, cancel: body.cancel}, false},
+		// not set by the proxy
+		{other, other, false},
+		{nil, nil, false},
+		// a body that cannot be compared
+		{uncomparable, uncomparable, false},
+	}
+	for _, tc := range tests {
+		if result := sameBody(tc.a, tc.b); result != tc.expected {
+			t.Errorf("Expected: %v, but got: %v", tc.expected, result)
+		}
+	}
+}
+
+func TestHandleResponseRequestBody(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		bufferSize int64
+		changed    bool
+		want       string
+	}{
+		{"forwarded as is", 0, false, "original body"},
+		{"changed by HandleRequestBody", 0, true, "original body"},
+		{"bigger than MaxBodyBufferSize", 8, false, "original"},
+	}
+	for _, tt := range tests {
+		p, client, cleanup := NewTestProxy(t)
+		p.MaxBodyBufferSize = tt.bufferSize
+		if tt.changed {
+			p.HandleRequestBody = func(id int64, req *http.Request, body []byte) []byte {
+				return []byte("changed")
+			}
+		}
+		var body, again []byte
+		p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+			body, _ = io.ReadAll(req.Body)
+			if r, err := req.GetBody(); err == nil {
+				again, _ = io.ReadAll(r)
+			}
+		}
+		resp, err := client.Post(upstream.URL, "text/plain", strings.NewReader("original body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		cleanup()
+
+		if string(body) != tt.want || string(again) != tt.want {
+			t.Errorf("%s: Expected: %q, but got: %q and %q", tt.name, tt.want, body, again)
+		}
+		if wantReceived := map[bool]string{false: "original body", true: "changed"}[tt.changed]; received != wantReceived {
+			t.Errorf("%s: Expected the server to get: %q, but got: %q", tt.name, wantReceived, received)
+		}
+	}
+}
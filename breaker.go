@@ -0,0 +1,125 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCircuitCooldown is the time a circuit stays open when
+// CircuitBreaker.Cooldown is zero.
+const DefaultCircuitCooldown = 30 * time.Second
+
+// ErrCircuitOpen is returned for the requests to a host whose circuit is
+// open, the client gets a 503.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitBreaker fails the requests to a remote host right away, without
+// waiting for the timeouts, after Failures consecutive failures within
+// Window. The circuit stays open for Cooldown, then a single request is let
+// through to probe the host: the circuit is closed if it succeeds and open
+// again otherwise.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures that opens the
+	// circuit of a host.
+	Failures int
+	// Window is the time within which the failures must happen, no limit
+	// if zero.
+	Window time.Duration
+	// Cooldown is how long the circuit stays open, DefaultCircuitCooldown
+	// if zero.
+	Cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+// circuit is the state of a host that failed. The hosts that answer are
+// not kept.
+type circuit struct {
+	failures  int
+	first     time.Time
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return b.Cooldown
+	}
+	return DefaultCircuitCooldown
+}
+
+// allow returns ErrCircuitOpen if the circuit of host is open, or if the
+// cooldown is over and another request is already probing host.
+func (b *CircuitBreaker) allow(host string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil || c.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+	c.probing = true
+	return nil
+}
+
+// report records the outcome of a request to host allowed by allow and
+// tells whether the circuit has just been opened. The requests canceled by
+// the clients or refused by the proxy do not count.
+func (b *CircuitBreaker) report(host string, err error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	switch {
+	case err == nil:
+		delete(b.hosts, host)
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, ErrRequestBodyTooLarge), errors.Is(err, ErrPrivateNetwork):
+		if c != nil {
+			c.probing = false
+		}
+		return false
+	}
+	now := time.Now()
+	if c == nil {
+		if b.hosts == nil {
+			b.hosts = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	if c.probing {
+		c.probing = false
+		c.openUntil = now.Add(b.cooldown())
+		return true
+	}
+	if c.failures == 0 || (b.Window > 0 && now.Sub(c.first) > b.Window) {
+		c.failures = 0
+		c.first = now
+	}
+	c.failures++
+	if c.failures < b.Failures || !c.openUntil.IsZero() {
+		return false
+	}
+	c.openUntil = now.Add(b.cooldown())
+	return true
+}
+
+// reportCircuit records the outcome of a request to host.
+func (p *Proxy) reportCircuit(host string, err error) {
+	if p.CircuitBreaker.report(host, err) {
+		p.logger().Infof("Circuit to %s open for %v: %v", host, p.CircuitBreaker.cooldown(), err)
+	}
+}
@@ -0,0 +1,140 @@
+package yves
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	failure := errors.New("connection refused")
+	b := &CircuitBreaker{Failures: 3, Cooldown: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if err := b.allow("example.com:443"); err != nil {
+			t.Fatalf("Expected the circuit to be closed, but got: %v", err)
+		}
+		b.report("example.com:443", failure)
+	}
+	if err := b.allow("example.com:443"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected: %v, but got: %v", ErrCircuitOpen, err)
+	}
+	// the other hosts are not affected
+	if err := b.allow("example.org:443"); err != nil {
+		t.Errorf("Expected: %v, but got: %v", nil, err)
+	}
+
+	// a single probe after the cooldown
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow("example.com:443"); err != nil {
+		t.Errorf("Expected the probe to be allowed, but got: %v", err)
+	}
+	if err := b.allow("example.com:443"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected: %v, but got: %v", ErrCircuitOpen, err)
+	}
+	if opened := b.report("example.com:443", failure); !opened {
+		t.Errorf("Expected the failed probe to open the circuit again")
+	}
+	if err := b.allow("example.com:443"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected: %v, but got: %v", ErrCircuitOpen, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow("example.com:443"); err != nil {
+		t.Errorf("Expected the probe to be allowed, but got: %v", err)
+	}
+	b.report("example.com:443", nil)
+	for i := 0; i < 2; i++ {
+		if err := b.allow("example.com:443"); err != nil {
+			t.Errorf("Expected the circuit to be closed, but got: %v", err)
+		}
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	failure := errors.New("connection refused")
+	b := &CircuitBreaker{Failures: 2, Window: 20 * time.Millisecond}
+	b.report("example.com:80", failure)
+	time.Sleep(30 * time.Millisecond)
+	if b.report("example.com:80", failure) {
+		t.Errorf("Expected the failures out of the window not to open the circuit")
+	}
+	if !b.report("example.com:80", failure) {
+		t.Errorf("Expected the failures within the window to open the circuit")
+	}
+	if err := b.allow("example.com:80"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected: %v, but got: %v", ErrCircuitOpen, err)
+	}
+}
+
+// failingServer accepts the connections and closes them right away.
+func failingServer(t *testing.T) (net.Listener, *int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	return ln, &accepted
+}
+
+func TestCircuitBreakerRequests(t *testing.T) {
+	ln, accepted := failingServer(t)
+	defer ln.Close()
+
+	p := NewProxy()
+	p.CircuitBreaker = &CircuitBreaker{Failures: 2, Cooldown: time.Minute}
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		_, err := p.forwardReq(p.newSession(), req, "http://"+ln.Addr().String())
+		want := http.StatusBadGateway
+		if i >= 2 {
+			want = http.StatusServiceUnavailable
+		}
+		if code := errorStatus(err, http.StatusInternalServerError); code != want {
+			t.Errorf("Expected: %d, but got: %d (%v)", want, code, err)
+		}
+	}
+	if n := atomic.LoadInt64(accepted); n != 2 {
+		t.Errorf("Expected: 2 connections, but got: %d", n)
+	}
+}
+
+func TestCircuitBreakerConnect(t *testing.T) {
+	ln, accepted := failingServer(t)
+	addr := ln.Addr().String()
+	// the port is closed, the dial fails
+	ln.Close()
+
+	p, _, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.CircuitBreaker = &CircuitBreaker{Failures: 1, Cooldown: time.Minute}
+	for _, want := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+		var code int
+		fmt.Fscanf(conn, "HTTP/1.1 %d", &code)
+		conn.Close()
+		if code != want {
+			t.Errorf("Expected: %d, but got: %d", want, code)
+		}
+	}
+	if n := atomic.LoadInt64(accepted); n != 0 {
+		t.Errorf("Expected: 0 connections, but got: %d", n)
+	}
+}
@@ -0,0 +1,135 @@
+package yves
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CAHost is the host serving the CA certificate of the proxy to the clients
+// that use it: http://yves.proxy/ca.pem in PEM format and
+// http://yves.proxy/ca.crt in DER format.
+const CAHost = "yves.proxy"
+
+// GenerateCA generates a new CA certificate, with an ECDSA P-256 key, to
+// be used as CaCert and CaKey. The certificate is valid for validity, five
+// years if zero.
+func GenerateCA(commonName string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if validity == 0 {
+		validity = caMaxAge
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate serial number: %s", err)
+	}
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"yves"}},
+		// allow for clients whose clock is a bit late
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// UseGeneratedCA makes the proxy use a new CA generated with GenerateCA
+// instead of the default one, so that every instance has its own CA. It
+// must be called before the proxy starts serving clients, and has no
+// effect if Signer is set.
+func (p *Proxy) UseGeneratedCA() error {
+	certPEM, keyPEM, err := GenerateCA("yves CA", 0)
+	if err != nil {
+		return err
+	}
+	p.certMutex.Lock()
+	defer p.certMutex.Unlock()
+	p.CaCert = certPEM
+	p.CaKey = keyPEM
+	// the certificates signed by the previous CA are useless
+	p.certCache = make(map[string]*tls.Certificate)
+	return nil
+}
+
+// CACertificateDER returns the CA certificate used to sign the generated
+// certificates in DER format, nil if it cannot be loaded.
+func (p *Proxy) CACertificateDER() []byte {
+	signer, err := p.signer()
+	if err != nil {
+		return nil
+	}
+	return signer.Certificate().Raw
+}
+
+// CACertificatePEM returns the CA certificate used to sign the generated
+// certificates in PEM format, to be installed in the trust store of the
+// clients. nil is returned if it cannot be loaded.
+func (p *Proxy) CACertificatePEM() []byte {
+	der := p.CACertificateDER()
+	if der == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// isCAHost tells whether host, which can contain a port, is CAHost.
+func isCAHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, CAHost)
+}
+
+// serveCA answers a request to CAHost.
+func (p *Proxy) serveCA(clientConn net.Conn, req *http.Request) {
+	var body []byte
+	header := http.Header{}
+	switch req.URL.Path {
+	case "/ca.pem":
+		body = p.CACertificatePEM()
+		header.Set("Content-Type", "application/x-pem-file")
+		header.Set("Content-Disposition", `attachment; filename="yves-ca.pem"`)
+	case "/ca.crt", "/ca.der":
+		body = p.CACertificateDER()
+		header.Set("Content-Type", "application/x-x509-ca-cert")
+		header.Set("Content-Disposition", `attachment; filename="yves-ca.crt"`)
+	default:
+		HttpError(clientConn, "Download the CA certificate from /ca.pem or /ca.crt", http.StatusNotFound)
+		return
+	}
+	if body == nil {
+		HttpError(clientConn, "CA certificate not available", http.StatusInternalServerError)
+		return
+	}
+	resp := NewResponse(http.StatusOK, header, body)
+	resp.Close = true
+	resp.Write(clientConn)
+}
@@ -0,0 +1,115 @@
+package yves
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCACertificate(t *testing.T) {
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+
+	block, _ := pem.Decode(p.CACertificatePEM())
+	if block == nil {
+		t.Fatalf("Expected a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(p.CACertificateDER())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.IsCA {
+		t.Errorf("Expected a CA certificate")
+	}
+
+	testCases := []struct {
+		path        string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{"/ca.pem", http.StatusOK, "application/x-pem-file", p.CACertificatePEM()},
+		{"/ca.crt", http.StatusOK, "application/x-x509-ca-cert", block.Bytes},
+		{"/other", http.StatusNotFound, "text/plain; charset=utf-8", nil},
+	}
+	for _, tc := range testCases {
+		resp, err := client.Get("http://" + CAHost + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get("Content-Type") != tc.contentType {
+			t.Errorf("Expected: %d %s, but got: %d %s", tc.status, tc.contentType, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if tc.body != nil && string(body) != string(tc.body) {
+			t.Errorf("Expected the CA certificate, but got: %q", body)
+		}
+	}
+}
+
+func TestGenerateCA(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+	if !ca.Leaf.IsCA || ca.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Errorf("Expected a CA certificate, but got: %v %v", ca.Leaf.IsCA, ca.Leaf.KeyUsage)
+	}
+	if ca.Leaf.Subject.CommonName != "test CA" || time.Until(ca.Leaf.NotAfter) > time.Hour || time.Until(ca.Leaf.NotAfter) < 59*time.Minute {
+		t.Errorf("Unexpected certificate: %s valid until %v", ca.Leaf.Subject, ca.Leaf.NotAfter)
+	}
+
+	leaf, err := GenerateCert(ca, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+		t.Errorf("Expected the leaf to be signed by the CA: %v", err)
+	}
+}
+
+func TestUseGeneratedCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	if err := p.UseGeneratedCA(); err != nil {
+		t.Fatal(err)
+	}
+	if string(p.CaCert) == string(caCert) {
+		t.Fatalf("Expected a new CA")
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	for _, ca := range [][]byte{p.CACertificatePEM(), caCert} {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(ca)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+		resp, err := client.Get(upstream.URL)
+		if trusted := string(ca) != string(caCert); trusted != (err == nil) {
+			t.Errorf("Expected the generated CA only to be trusted, but got: %v", err)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package yves
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certFileExt = ".pem"
+
+// SaveCertCache writes every certificate generated so far in dir, one
+// file per host containing the certificate and its private key in PEM format.
+func (p *Proxy) SaveCertCache(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	p.certMutex.RLock()
+	defer p.certMutex.RUnlock()
+	for host, cert := range p.certCache {
+		if err := saveCert(dir, host, cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCertCache loads in the cache the certificates saved in dir by
+// SaveCertCache. Expired certificates and certificates that were not signed
+// by the CA of the proxy are discarded.
+func (p *Proxy) LoadCertCache(dir string) error {
+	signer, err := p.signer()
+	if err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	p.certMutex.Lock()
+	defer p.certMutex.Unlock()
+	if p.certCache == nil {
+		p.certCache = make(map[string]*tls.Certificate)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), certFileExt) {
+			continue
+		}
+		host, err := url.PathUnescape(strings.TrimSuffix(f.Name(), certFileExt))
+		if err != nil {
+			continue
+		}
+		cert, err := loadCert(filepath.Join(dir, f.Name()), signer.Certificate())
+		if err != nil {
+			continue
+		}
+		p.certCache[host] = cert
+	}
+	return nil
+}
+
+// saveCert writes cert and its key in a file named after host.
+func saveCert(dir, host string, cert *tls.Certificate) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, c := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+	name := filepath.Join(dir, url.PathEscape(host)+certFileExt)
+	return os.WriteFile(name, data, 0600)
+}
+
+// loadCert reads a certificate written by saveCert and checks that it is
+// still valid and signed by ca.
+func loadCert(name string, ca *x509.Certificate) (*tls.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !certFresh(&cert, time.Now()) {
+		return nil, errors.New("certificate expired")
+	}
+	if err := cert.Leaf.CheckSignatureFrom(ca); err != nil {
+		return nil, fmt.Errorf("certificate not signed by the CA: %w", err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,57 @@
+package yves
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCertCachePersistence(t *testing.T) {
+	dir := t.TempDir()
+	signer := testSigner(t)
+
+	p := NewProxy()
+	p.CertCacheDir = dir
+	cert, err := p.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := NewProxy()
+	if err := p2.LoadCertCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := p2.certCache["example.com"]
+	if !ok {
+		t.Fatal("Expected the certificate to be loaded")
+	}
+	if !loaded.Leaf.Equal(cert.Leaf) {
+		t.Errorf("Loaded certificate differs from the saved one")
+	}
+}
+
+func TestCertCacheDiscardsOtherCA(t *testing.T) {
+	dir := t.TempDir()
+	p := NewProxy()
+	if _, err := p.getCert(testSigner(t), "example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SaveCertCache(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// a proxy with a different CA must not trust the cache
+	p2 := NewProxy()
+	var err error
+	if p2.CaCert, err = os.ReadFile("examples/custom-ca/demo.pem"); err != nil {
+		t.Fatal(err)
+	}
+	if p2.CaKey, err = os.ReadFile("examples/custom-ca/demo.key.pem"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.LoadCertCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(p2.certCache) != 0 {
+		t.Errorf("Expected certificates signed by another CA to be discarded")
+	}
+}
@@ -0,0 +1,436 @@
+package yves
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ConnectActionType is what the proxy does with a CONNECT request.
+type ConnectActionType int
+
+const (
+	// ConnectAllow intercepts the connection (Man-in-The-Middle).
+	ConnectAllow ConnectActionType = iota
+	// ConnectTunnel relays the connection without decrypting it.
+	ConnectTunnel
+	// ConnectReject refuses the connection.
+	ConnectReject
+)
+
+// ConnectAction is returned by HandleConnect.
+type ConnectAction struct {
+	Action ConnectActionType
+
+	// StatusCode and Body are sent to the client when the CONNECT is
+	// rejected. StatusCode defaults to 403.
+	StatusCode int
+	Body       string
+}
+
+// connectAction asks HandleConnect what to do with a CONNECT to host.
+func (p *Proxy) connectAction(ctx context.Context, host string) ConnectAction {
+	if p.HandleConnect == nil {
+		return ConnectAction{Action: ConnectAllow}
+	}
+	return p.HandleConnect(ctx.Value("session").(int64), host)
+}
+
+// rejectConnect answers the client with the status code and the body of action.
+func rejectConnect(clientConn net.Conn, action ConnectAction) {
+	code := action.StatusCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+	body := action.Body
+	if body == "" {
+		body = http.StatusText(code)
+	}
+	HttpError(clientConn, body, code)
+}
+
+// errTLSPassthrough fails the handshake with a client connecting to one of
+// the TLSPassthroughHosts, for the connection to be tunneled.
+var errTLSPassthrough = errors.New("TLS passthrough host")
+
+// tunnel relays bytes between the client and host without decrypting them.
+func (p *Proxy) tunnel(ctx context.Context, clientConn net.Conn, host string) {
+	targetConn, err := p.dialUpstream(context.Background(), host)
+	if err != nil {
+		HttpError(clientConn, err.Error(), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn.Write([]byte(okHeader))
+	p.logger().Debugf("Tunneling connection to %s", host)
+	p.relay(ctx, host, clientConn, targetConn)
+}
+
+// replayTunnel tunnels the connection with the client to host, first
+// sending what the client has already sent to the proxy.
+func (p *Proxy) replayTunnel(ctx context.Context, clientConn net.Conn, host string, received []byte) {
+	targetConn, err := p.dialUpstream(context.Background(), host)
+	if err != nil {
+		return
+	}
+	defer targetConn.Close()
+
+	if _, err := targetConn.Write(received); err != nil {
+		return
+	}
+	p.relay(ctx, host, clientConn, targetConn)
+}
+
+// relay relays the bytes between the client and host, with HandleTunnel if
+// set, then closes both connections.
+func (p *Proxy) relay(ctx context.Context, host string, clientConn, targetConn net.Conn) {
+	if p.HandleTunnel == nil {
+		splice(clientConn, targetConn)
+		return
+	}
+	p.HandleTunnel(ctx.Value("session").(int64), host, clientConn, targetConn)
+	targetConn.Close()
+	clientConn.Close()
+}
+
+// splice copies bytes in both directions until both sides are done. When
+// one side stops sending, the other one is half-closed, so that it gets EOF
+// but can still send the rest of its data, e.g. the response to an upload.
+// Connections that cannot be half-closed are closed, along with the other
+// side.
+func splice(clientConn, targetConn net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		if _, err := io.Copy(dst, src); err != nil || closeWrite(dst) != nil {
+			// closing both connections makes the other copy return
+			dst.Close()
+			src.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(targetConn, clientConn)
+	go pipe(clientConn, targetConn)
+	<-done
+	<-done
+	targetConn.Close()
+	clientConn.Close()
+}
+
+// errNoCloseWrite is returned by closeWrite for the connections that cannot
+// be half-closed.
+var errNoCloseWrite = errors.New("half-close not supported")
+
+// closeWrite shuts down the writing side of conn: a FIN for TCP, a
+// close_notify alert for TLS. The wrappers of the connections implement
+// CloseWrite by calling closeWrite with the connection they wrap.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+// probeTLSTimeout is the maximum time to wait for the destination of a
+// CONNECT to complete a TLS handshake.
+const probeTLSTimeout = 2 * time.Second
+
+// probeTLS checks whether the destination of a CONNECT speaks TLS by
+// performing a handshake on conn. The returned connection can be reused by
+// the transport when it would have accepted the certificate of the server.
+func (p *Proxy) probeTLS(conn net.Conn, addr string) (*tls.Conn, bool, error) {
+	conf := p.upstreamTLSConfig(addr)
+	insecure := conf.InsecureSkipVerify
+	verify := conf.VerifyConnection
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = nil
+	conf.NextProtos = nil
+
+	tlsConn := tls.Client(conn, conf)
+	tlsConn.SetDeadline(time.Now().Add(probeTLSTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, false, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	state := tlsConn.ConnectionState()
+	reusable := p.upstreamProxy(httpsRequest(addr)) == nil &&
+		(insecure || verifyPeer(state, conf.RootCAs, conf.ServerName) == nil) &&
+		(verify == nil || verify(state) == nil)
+	return tlsConn, reusable, nil
+}
+
+// upstreamTLSConfig returns the configuration to start a TLS connection
+// with addr, based on the transport configuration.
+func (p *Proxy) upstreamTLSConfig(addr string) *tls.Config {
+	conf := &tls.Config{}
+	if p.Tr != nil && p.Tr.TLSClientConfig != nil {
+		conf = p.Tr.TLSClientConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		conf.ServerName = host
+	}
+	conf.VerifyConnection = p.verifyUpstream(addr)
+	return conf
+}
+
+// verifyUpstream returns the function verifying the certificate of addr
+// when VerifyUpstream is set. It is the VerifyConnection of the TLS
+// configurations, so it is called whatever InsecureSkipVerify says. The
+// transport itself establishes the TLS connections going through an
+// upstream proxy, for those addr is empty and the name sent in the SNI
+// is verified.
+func (p *Proxy) verifyUpstream(addr string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if !p.VerifyUpstream {
+			return nil
+		}
+		host := state.ServerName
+		if addr != "" {
+			host = addr
+			if h, _, err := net.SplitHostPort(addr); err == nil {
+				host = h
+			}
+		}
+		if host == "" {
+			return errors.New("tls: cannot verify a certificate without the name of the server")
+		}
+		if hostMatchesAny(p.InsecureHosts, host) {
+			return nil
+		}
+		var roots *x509.CertPool
+		if p.Tr != nil && p.Tr.TLSClientConfig != nil {
+			roots = p.Tr.TLSClientConfig.RootCAs
+		}
+		return verifyPeer(state, roots, host)
+	}
+}
+
+// verifyPeer verifies the certificates received on a TLS connection with
+// name against roots, the system roots if nil.
+func verifyPeer(state tls.ConnectionState, roots *x509.CertPool, name string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// dialTLS is used as the transport DialTLSContext. It returns a connection
+// established while handling a CONNECT to addr if there is one, or dials a
+// new one otherwise.
+func (p *Proxy) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := p.takeUpstreamConn(addr); conn != nil {
+		return conn, nil
+	}
+	conn, err := p.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, p.upstreamTLSConfig(addr))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (p *Proxy) putUpstreamConn(addr string, conn net.Conn) {
+	p.upstreamConnsMutex.Lock()
+	defer p.upstreamConnsMutex.Unlock()
+	if p.upstreamConns == nil {
+		p.upstreamConns = make(map[string][]net.Conn)
+	}
+	p.upstreamConns[addr] = append(p.upstreamConns[addr], conn)
+}
+
+func (p *Proxy) takeUpstreamConn(addr string) net.Conn {
+	p.upstreamConnsMutex.Lock()
+	defer p.upstreamConnsMutex.Unlock()
+	conns := p.upstreamConns[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	p.upstreamConns[addr] = conns[:len(conns)-1]
+	if len(p.upstreamConns[addr]) == 0 {
+		delete(p.upstreamConns, addr)
+	}
+	return conn
+}
+
+// dropUpstreamConn closes conn if it has not been used by the transport.
+func (p *Proxy) dropUpstreamConn(addr string, conn net.Conn) {
+	p.upstreamConnsMutex.Lock()
+	defer p.upstreamConnsMutex.Unlock()
+	conns := p.upstreamConns[addr]
+	for i, c := range conns {
+		if c == conn {
+			conn.Close()
+			p.upstreamConns[addr] = append(conns[:i], conns[i+1:]...)
+			if len(p.upstreamConns[addr]) == 0 {
+				delete(p.upstreamConns, addr)
+			}
+			return
+		}
+	}
+}
+
+func (p *Proxy) addFailedHost(host string) {
+	p.failedHostsMutex.Lock()
+	defer p.failedHostsMutex.Unlock()
+	if p.failedHosts == nil {
+		p.failedHosts = make(map[string]bool)
+	}
+	p.failedHosts[host] = true
+}
+
+func (p *Proxy) isFailedHost(host string) bool {
+	p.failedHostsMutex.Lock()
+	defer p.failedHostsMutex.Unlock()
+	return p.failedHosts[host]
+}
+
+// handshakeConn records what the client sends during the TLS handshake so
+// that it can be replayed to the real server if the handshake fails.
+type handshakeConn struct {
+	net.Conn
+	recording bool
+	recorded  bytes.Buffer
+	// muted discards what the proxy writes to the client.
+	muted bool
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording {
+		c.recorded.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	if c.muted {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *handshakeConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *handshakeConn) stopRecording() {
+	c.recording = false
+	c.recorded = bytes.Buffer{}
+}
+
+// The protocols recognized by sniffClient.
+const (
+	protocolUnknown = iota
+	protocolTLS
+	protocolHTTP
+)
+
+// sniffTimeout is how long sniffClient waits for the client to speak.
+var sniffTimeout = time.Second
+
+// sniffClient looks at the first bytes sent by the client to tell whether it
+// starts a TLS handshake or sends an HTTP request. The protocol is unknown
+// if the client sends something else or waits for the server to speak
+// first. The returned connection replays what has been read.
+func sniffClient(conn net.Conn) (net.Conn, int, error) {
+	// long enough for the longest methods, e.g. MKCALENDAR
+	buf := make([]byte, 16)
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, protocolUnknown, err
+			}
+			break
+		}
+		if buf[0] == 0x16 || bytes.IndexByte(buf[:n], ' ') >= 0 {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sniffed := &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf[:n]), conn)}
+	switch {
+	case n == 0:
+		return sniffed, protocolUnknown, nil
+	case buf[0] == 0x16:
+		// the type of the TLS record carrying the ClientHello
+		return sniffed, protocolTLS, nil
+	case isHTTPMethod(buf[:n]):
+		return sniffed, protocolHTTP, nil
+	}
+	return sniffed, protocolUnknown, nil
+}
+
+// isHTTPMethod tells whether b starts with an HTTP method followed by a space.
+func isHTTPMethod(b []byte) bool {
+	i := bytes.IndexByte(b, ' ')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range b[:i] {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// tlsTunnel relays what the client sends in a TLS connection that is not
+// HTTP to a TLS connection with host, negotiating protocol if set. The
+// connection opened while handling the CONNECT is used if possible.
+func (p *Proxy) tlsTunnel(ctx context.Context, clientConn net.Conn, host, protocol string) {
+	var targetConn net.Conn
+	if protocol == "" {
+		// the connection of the probe did not use ALPN either
+		targetConn = p.takeUpstreamConn(host)
+	}
+	if targetConn == nil {
+		conn, err := p.dialUpstream(context.Background(), host)
+		if err != nil {
+			return
+		}
+		conf := p.upstreamTLSConfig(host)
+		conf.NextProtos = nil
+		if protocol != "" {
+			conf.NextProtos = []string{protocol}
+		}
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		targetConn = tlsConn
+	}
+	defer targetConn.Close()
+	p.logger().Debugf("Tunneling TLS connection to %s", host)
+	p.relay(ctx, host, clientConn, targetConn)
+}
@@ -0,0 +1,762 @@
+package yves
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	// the upstream certificate is trusted only if the connection is not intercepted
+	client := upstream.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+
+	p.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectTunnel}
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Tunneled connection failed: %v", err)
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	p.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectReject, StatusCode: http.StatusTeapot}
+	}
+	_, err = client.Get(upstream.URL)
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusTeapot)) {
+		t.Errorf("Expected the CONNECT to be rejected, but got: %v", err)
+	}
+
+	p.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectAllow}
+	}
+	_, err = client.Get(upstream.URL)
+	if err == nil {
+		t.Errorf("Expected the forged certificate not to be trusted")
+	}
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if resp, err = client.Get(upstream.URL); err != nil {
+		t.Fatalf("Intercepted connection failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// failingSigner never signs a certificate.
+type failingSigner struct {
+	CertSigner
+}
+
+func (s failingSigner) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	return nil, errors.New("cannot sign")
+}
+
+func TestTunnelOnHandshakeFailure(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	p.TunnelOnHandshakeFailure = true
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := upstream.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+
+	// the client refuses the forged certificate the first time
+	if _, err := client.Get(upstream.URL); err == nil {
+		t.Fatal("Expected the forged certificate not to be trusted")
+	}
+	// the proxy may notice the failure after the client
+	host := upstream.Listener.Addr().String()
+	for i := 0; i < 100 && !p.isFailedHost(host); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// and the connection is tunneled the second time
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected the connection to be tunneled, but got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestTunnelOnCertificateFailure(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	p.TunnelOnHandshakeFailure = true
+	p.Signer = failingSigner{testSigner(t)}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := upstream.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected the connection to be tunneled, but got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestConnectUnreachableHost(t *testing.T) {
+	// get a port where nobody is listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected: 502, but got: %d", resp.StatusCode)
+	}
+}
+
+func TestConnectReusesUpstreamConnection(t *testing.T) {
+	var dials int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&dials, 1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected a single connection to the server, but got %d", n)
+	}
+}
+
+// echoServer echoes what it receives, after sending banner if not empty.
+func echoServer(ln net.Listener, banner string) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, banner)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// connectTunnel opens a CONNECT tunnel to host through the proxy at proxyAddr.
+func connectTunnel(t *testing.T, proxyAddr, host string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	return conn, r
+}
+
+func TestConnectRawTCP(t *testing.T) {
+	defer func(d time.Duration) { sniffTimeout = d }(sniffTimeout)
+	sniffTimeout = 100 * time.Millisecond
+
+	proxyServer := httptest.NewServer(NewProxy())
+	defer proxyServer.Close()
+
+	testCases := []struct {
+		name   string
+		banner string
+	}{
+		// the server speaks first, like SSH
+		{"server first", "SSH-2.0-test\r\n"},
+		// the client speaks first, like XMPP
+		{"client first", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, _ := net.Listen("tcp", "127.0.0.1:0")
+			defer ln.Close()
+			echoServer(ln, tc.banner)
+
+			conn, r := connectTunnel(t, proxyServer.Listener.Addr().String(), ln.Addr().String())
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if tc.banner != "" {
+				line, err := r.ReadString('\n')
+				if err != nil || line != tc.banner {
+					t.Fatalf("Expected: %q, but got: %q (%v)", tc.banner, line, err)
+				}
+			}
+			io.WriteString(conn, "<stream:stream>\n")
+			line, err := r.ReadString('\n')
+			if err != nil || line != "<stream:stream>\n" {
+				t.Errorf("Expected: <stream:stream>, but got: %q (%v)", line, err)
+			}
+		})
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	// the server answers once the client is done sending, like a
+	// request body ended by a FIN
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(conn, "received %d bytes", n)
+	}()
+
+	proxyServer := httptest.NewServer(NewProxy())
+	defer proxyServer.Close()
+	conn, r := connectTunnel(t, proxyServer.Listener.Addr().String(), ln.Addr().String())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	upload := strings.Repeat("x", 1<<20)
+	if _, err := io.WriteString(conn, upload); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	answer, err := io.ReadAll(r)
+	if want := fmt.Sprintf("received %d bytes", len(upload)); err != nil || string(answer) != want {
+		t.Errorf("Expected: %q, but got: %q (%v)", want, answer, err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the wrappers of the connections half-close the connection they wrap
+	wrapped := &countingConn{Conn: &peekedConn{Conn: conn, r: conn}, read: new(int64), written: new(int64)}
+	if err := closeWrite(wrapped); err != nil {
+		t.Errorf("Expected: %v, but got: %v", nil, err)
+	}
+	if err := closeWrite(&peekedConn{Conn: &handshakeConn{}}); err != errNoCloseWrite {
+		t.Errorf("Expected: %v, but got: %v", errNoCloseWrite, err)
+	}
+}
+
+func TestConnectTLSNotHTTP(t *testing.T) {
+	defer func(d time.Duration) { sniffTimeout = d }(sniffTimeout)
+	sniffTimeout = 100 * time.Millisecond
+
+	tcpLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln := tls.NewListener(tcpLn, &tls.Config{Certificates: []tls.Certificate{testCA(t)}})
+	defer ln.Close()
+	echoServer(ln, "* OK IMAP4rev1\r\n")
+
+	p := NewProxy()
+	var dials int32
+	p.Dialer = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial(network, addr)
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, _ := connectTunnel(t, proxyServer.Listener.Addr().String(), ln.Addr().String())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	r := bufio.NewReader(tlsConn)
+	line, err := r.ReadString('\n')
+	if err != nil || line != "* OK IMAP4rev1\r\n" {
+		t.Fatalf("Expected the greeting of the server, but got: %q (%v)", line, err)
+	}
+	io.WriteString(tlsConn, "a1 NOOP\r\n")
+	if line, err = r.ReadString('\n'); err != nil || line != "a1 NOOP\r\n" {
+		t.Errorf("Expected: a1 NOOP, but got: %q (%v)", line, err)
+	}
+	// the connection of the TLS probe is used
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected a single connection to the server, but got %d", n)
+	}
+}
+
+func TestVerifyUpstream(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	// the certificate of the server is valid for example.com
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	target := "https://example.com:" + port
+	dialer := func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	}
+
+	// an upstream proxy tunneling the connections
+	upstreamProxy, _, cleanupUpstream := NewTestProxy(t)
+	defer cleanupUpstream()
+	upstreamProxy.Dialer = dialer
+	upstreamProxy.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectTunnel}
+	}
+
+	for _, viaProxy := range []bool{false, true} {
+		p, client, cleanup := NewTestProxy(t)
+		defer cleanup()
+		if viaProxy {
+			p.Tr.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: upstreamProxy.Addr().String()})
+		} else {
+			p.Dialer = dialer
+		}
+		get := func() (int, string) {
+			resp, err := client.Get(target)
+			if err != nil {
+				t.Fatalf("via proxy: %v: %v", viaProxy, err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			p.Tr.CloseIdleConnections()
+			return resp.StatusCode, string(body)
+		}
+
+		if status, body := get(); status != http.StatusOK {
+			t.Errorf("Expected: 200 without verification, but got: %d %s", status, body)
+		}
+		p.VerifyUpstream = true
+		if status, body := get(); status != http.StatusBadGateway || !strings.Contains(body, "certificate") {
+			t.Errorf("Expected: 502 with a certificate error (via proxy: %v), but got: %d %s", viaProxy, status, body)
+		}
+		p.InsecureHosts = []string{"*.com"}
+		if status, body := get(); status != http.StatusOK {
+			t.Errorf("Expected: 200 for an insecure host (via proxy: %v), but got: %d %s", viaProxy, status, body)
+		}
+		p.InsecureHosts = nil
+		p.Tr.TLSClientConfig.RootCAs = roots
+		if status, body := get(); status != http.StatusOK {
+			t.Errorf("Expected: 200 with the right roots (via proxy: %v), but got: %d %s", viaProxy, status, body)
+		}
+	}
+}
+
+func TestHandleUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	var states []tls.ConnectionState
+	p.HandleUpstreamTLS = func(session int64, state tls.ConnectionState) {
+		states = append(states, state)
+	}
+	var respTLS *tls.ConnectionState
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		respTLS = resp.TLS
+	}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(states) != 1 {
+		t.Fatalf("Expected: 1 TLS state, but got: %d", len(states))
+	}
+	state := states[0]
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("Expected: %x, but got: %x", tls.VersionTLS13, state.Version)
+	}
+	if tls.CipherSuiteName(state.CipherSuite) == "" {
+		t.Errorf("Expected a cipher suite, but got: %x", state.CipherSuite)
+	}
+	if len(state.PeerCertificates) == 0 {
+		t.Fatalf("Expected the certificates of the server")
+	}
+	leaf := state.PeerCertificates[0]
+	if len(leaf.DNSNames) == 0 || leaf.DNSNames[0] != "example.com" {
+		t.Errorf("Expected: [example.com], but got: %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) == 0 || !leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected: [127.0.0.1], but got: %v", leaf.IPAddresses)
+	}
+	if !leaf.Equal(upstream.Certificate()) {
+		t.Errorf("Expected the certificate of the upstream server")
+	}
+	if respTLS == nil || respTLS.CipherSuite != state.CipherSuite {
+		t.Errorf("Expected the TLS state in HandleResponse, but got: %v", respTLS)
+	}
+
+	p.Scope = &Scope{ExcludeHosts: []string{"127.0.0.1"}}
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(states) != 1 {
+		t.Errorf("Expected: no TLS state out of scope, but got: %d", len(states))
+	}
+}
+
+func TestClientTLSState(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	var reqTLS *tls.ConnectionState
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		reqTLS = req.TLS
+		return nil
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	var tests = []struct {
+		h2         bool
+		maxVersion uint16
+		protocol   string
+	}{
+		{true, tls.VersionTLS13, "h2"},
+		// without HTTP/2 the client does not use ALPN
+		{false, tls.VersionTLS13, ""},
+		{false, tls.VersionTLS12, ""},
+	}
+	for _, tc := range tests {
+		reqTLS = nil
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyUrl),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, MaxVersion: tc.maxVersion},
+			ForceAttemptHTTP2: tc.h2,
+		}}
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if reqTLS == nil {
+			t.Fatalf("Expected the TLS state of the client")
+		}
+		if reqTLS.Version != tc.maxVersion {
+			t.Errorf("Expected: %x, but got: %x", tc.maxVersion, reqTLS.Version)
+		}
+		if reqTLS.NegotiatedProtocol != tc.protocol {
+			t.Errorf("Expected: %s, but got: %s", tc.protocol, reqTLS.NegotiatedProtocol)
+		}
+		if tls.CipherSuiteName(reqTLS.CipherSuite) == "" {
+			t.Errorf("Expected a cipher suite, but got: %x", reqTLS.CipherSuite)
+		}
+	}
+
+	// plain HTTP requests have none
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	resp, err := client.Get(plain.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if reqTLS != nil {
+		t.Errorf("Expected: no TLS state, but got: %v", reqTLS)
+	}
+}
+
+// newIPv6TLSServer starts a TLS server on the IPv6 loopback, the test is
+// skipped if there is none.
+func newIPv6TLSServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(handler)
+	upstream.Listener = l
+	upstream.StartTLS()
+	return upstream
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	tr := client.Transport.(*http.Transport)
+	var version uint16
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		version = req.TLS.Version
+		return nil
+	}
+
+	tests := []struct {
+		name          string
+		config        *tls.Config
+		clientVersion uint16
+		want          uint16
+	}{
+		{"defaults", nil, 0, tls.VersionTLS13},
+		{"TLS 1.3 only", &tls.Config{MinVersion: tls.VersionTLS13}, 0, tls.VersionTLS13},
+		{"TLS 1.3 only, old client", &tls.Config{MinVersion: tls.VersionTLS13}, tls.VersionTLS12, 0},
+		{"TLS 1.2", &tls.Config{MaxVersion: tls.VersionTLS12}, 0, tls.VersionTLS12},
+	}
+	for _, tt := range tests {
+		p.ClientTLSConfig = tt.config
+		tr.TLSClientConfig.MaxVersion = tt.clientVersion
+		tr.CloseIdleConnections()
+		version = 0
+		resp, err := client.Get(upstream.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != (tt.want == 0) {
+			t.Errorf("%s: Expected the request to fail: %v, but got: %v", tt.name, tt.want == 0, err)
+		}
+		if version != tt.want {
+			t.Errorf("%s: Expected: %x, but got: %x", tt.name, tt.want, version)
+		}
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	upstream := newIPv6TLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	var leaf *x509.Certificate
+	client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		leaf = state.PeerCertificates[0]
+		return nil
+	}
+	var requestURL string
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		requestURL = req.URL.String()
+		return nil
+	}
+
+	resp, err := client.Get(upstream.URL + "/path")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Errorf("Expected: hello, but got: %s", body)
+	}
+	if requestURL != upstream.URL+"/path" {
+		t.Errorf("Expected: %s, but got: %s", upstream.URL+"/path", requestURL)
+	}
+	if leaf == nil {
+		t.Fatalf("Expected a certificate from the proxy")
+	}
+	if len(leaf.DNSNames) != 0 {
+		t.Errorf("Expected: no DNS names, but got: %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.IPv6loopback) {
+		t.Errorf("Expected: [::1], but got: %v", leaf.IPAddresses)
+	}
+}
+
+func TestConnectWithoutSNI(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	p, _, cleanup := NewTestProxy(t)
+	defer cleanup()
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	target := net.JoinHostPort("localhost", port)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+
+	// without ServerName the client sends no SNI, the certificate is
+	// checked by hand below
+	var serverName string
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			serverName = state.ServerName
+			return nil
+		},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if serverName != "" {
+		t.Errorf("Expected: no SNI, but got: %s", serverName)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(p.CaCert)
+	leaf := tlsConn.ConnectionState().PeerCertificates[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: roots}); err != nil {
+		t.Errorf("Expected a certificate for the CONNECT target: %v", err)
+	}
+
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("Expected: hello, but got: %s", body)
+	}
+}
+
+func TestHandleTunnel(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	echoServer(ln, "")
+
+	p := NewProxy()
+	p.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectTunnel}
+	}
+	hosts := make(chan string, 1)
+	p.HandleTunnel = func(session int64, host string, client, server io.ReadWriter) {
+		hosts <- host
+		// half-closing is up to HandleTunnel
+		for _, conn := range []io.ReadWriter{client, server} {
+			if _, ok := conn.(interface{ CloseWrite() error }); !ok {
+				t.Errorf("Expected: CloseWrite, but got: %T", conn)
+			}
+		}
+		go io.Copy(client, server)
+		// the client speaks in lower case, the server gets upper case
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(server, strings.ToUpper(line))
+		}
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, r := connectTunnel(t, proxyServer.Listener.Addr().String(), ln.Addr().String())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if host := <-hosts; host != ln.Addr().String() {
+		t.Errorf("Expected: %s, but got: %s", ln.Addr(), host)
+	}
+	io.WriteString(conn, "hello\n")
+	line, err := r.ReadString('\n')
+	if err != nil || line != "HELLO\n" {
+		t.Errorf("Expected: HELLO, but got: %q (%v)", line, err)
+	}
+}
+
+func TestTLSPassthroughHosts(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	var tests = []struct {
+		passthrough []string
+		serverName  string
+		tunneled    bool
+	}{
+		// the destination of the CONNECT matches
+		{[]string{"127.0.0.0/8"}, "", true},
+		// the SNI matches
+		{[]string{"*.com"}, "example.com", true},
+		{[]string{"*.org"}, "example.com", false},
+	}
+	for _, tc := range tests {
+		p.TLSPassthroughHosts = tc.passthrough
+		conn, _ := connectTunnel(t, proxyServer.Listener.Addr().String(), upstream.Listener.Addr().String())
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		leaf := tlsConn.ConnectionState().PeerCertificates[0]
+		if tunneled := leaf.Equal(upstream.Certificate()); tunneled != tc.tunneled {
+			t.Errorf("Expected the connection to be tunneled: %v, but got: %v (%v)", tc.tunneled, tunneled, tc.passthrough)
+		}
+		tlsConn.Close()
+	}
+}
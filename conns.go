@@ -0,0 +1,129 @@
+package yves
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a connection of a client with the proxy.
+type ConnInfo struct {
+	// Session is the session of the first request sent on the connection.
+	Session    int64
+	RemoteAddr string
+	Opened     time.Time
+
+	// The following fields are only set when the connection is closed.
+	Duration time.Duration
+	// BytesReceived and BytesSent count the bytes read from and written to
+	// the client, including tunnels and websockets.
+	BytesReceived int64
+	BytesSent     int64
+	// Err is the first error reading from or writing to the client, other
+	// than the end of the connection or a deadline set by the proxy.
+	Err error
+}
+
+// trackedConn counts the bytes of a single connection and keeps its first
+// error.
+type trackedConn struct {
+	// first for the 64-bit alignment of the atomic operations
+	received int64
+	sent     int64
+	net.Conn
+
+	errMutex sync.Mutex
+	err      error
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	c.setErr(err)
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	c.setErr(err)
+	return n, err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// resetConn closes the TCP connection under conn with a RST rather than a
+// FIN. Nothing is sent before, not even the close_notify alert of TLS.
+func resetConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetLinger(0)
+			c.Close()
+			return
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *trackedConn:
+			conn = c.Conn
+		case *countingConn:
+			conn = c.Conn
+		case *handshakeConn:
+			conn = c.Conn
+		case *peekedConn:
+			conn = c.Conn
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (c *trackedConn) setErr(err error) {
+	var netErr net.Error
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// trackConn calls OnConnOpen for conn, the connection with a client, and
+// returns the connection to use instead along with the function closing it,
+// which then calls OnConnClose.
+func (p *Proxy) trackConn(ctx context.Context, conn net.Conn) (net.Conn, func()) {
+	if p.OnConnOpen == nil && p.OnConnClose == nil {
+		return conn, func() { conn.Close() }
+	}
+	info := ConnInfo{
+		Session:    ctx.Value("session").(int64),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Opened:     time.Now(),
+	}
+	if p.OnConnOpen != nil {
+		p.OnConnOpen(info)
+	}
+	tracked := &trackedConn{Conn: conn}
+	return tracked, func() {
+		conn.Close()
+		if p.OnConnClose == nil {
+			return
+		}
+		info.Duration = time.Since(info.Opened)
+		info.BytesReceived = atomic.LoadInt64(&tracked.received)
+		info.BytesSent = atomic.LoadInt64(&tracked.sent)
+		tracked.errMutex.Lock()
+		info.Err = tracked.err
+		tracked.errMutex.Unlock()
+		p.OnConnClose(info)
+	}
+}
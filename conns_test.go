@@ -0,0 +1,92 @@
+package yves
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// connEvents records the callbacks of p.
+func connEvents(p *Proxy) (opened, closed chan ConnInfo) {
+	opened = make(chan ConnInfo, 10)
+	closed = make(chan ConnInfo, 10)
+	p.OnConnOpen = func(info ConnInfo) {
+		opened <- info
+	}
+	p.OnConnClose = func(info ConnInfo) {
+		closed <- info
+	}
+	return opened, closed
+}
+
+func waitConnInfo(t *testing.T, events chan ConnInfo) ConnInfo {
+	t.Helper()
+	select {
+	case info := <-events:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for a connection event")
+	}
+	return ConnInfo{}
+}
+
+func TestConnCallbacks(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	opened, closed := connEvents(p)
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	open := waitConnInfo(t, opened)
+	if open.RemoteAddr == "" || open.Opened.IsZero() {
+		t.Errorf("Expected the address of the client and the opening time, but got: %+v", open)
+	}
+
+	client.CloseIdleConnections()
+	info := waitConnInfo(t, closed)
+	if info.Session != open.Session || info.RemoteAddr != open.RemoteAddr {
+		t.Errorf("Expected: %+v, but got: %+v", open, info)
+	}
+	// the TLS handshake and the request went through the CONNECT tunnel
+	if info.BytesReceived < 200 || info.BytesSent < 200 {
+		t.Errorf("Expected the bytes of the tunnel to be counted, but got: %+v", info)
+	}
+	if info.Duration <= 0 {
+		t.Errorf("Expected a duration, but got: %v", info.Duration)
+	}
+	if info.Err != nil {
+		t.Errorf("Expected: no error, but got: %v", info.Err)
+	}
+}
+
+func TestConnCloseOnError(t *testing.T) {
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.RequireAuth = func(user, pass string) bool {
+		return false
+	}
+	_, closed := connEvents(p)
+
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected: %d, but got: %d", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+	if info := waitConnInfo(t, closed); info.BytesSent == 0 {
+		t.Errorf("Expected the rejection to be counted, but got: %+v", info)
+	}
+}
@@ -0,0 +1,54 @@
+package yves
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// continueBody is the body of a request with Expect: 100-continue. The
+// client is told to send the body the first time it is read, that is when
+// the remote host answers with its own 100 Continue, or when a handler
+// reads the body.
+type continueBody struct {
+	io.ReadCloser
+	client io.Writer
+
+	mu   sync.Mutex
+	sent bool
+	err  error
+}
+
+// expectContinue wraps the body of req if the client waits for a 100
+// Continue before sending it.
+func expectContinue(req *http.Request, client io.Writer) *continueBody {
+	if !strings.EqualFold(req.Header.Get("Expect"), "100-continue") || req.ContentLength == 0 || req.Body == nil {
+		return nil
+	}
+	body := &continueBody{ReadCloser: req.Body, client: client}
+	req.Body = body
+	return body
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if !b.sent {
+		b.sent = true
+		_, b.err = io.WriteString(b.client, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	err := b.err
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// continued tells whether the client has been told to send the body. If not,
+// the client may still send it, so the connection cannot be reused.
+func (b *continueBody) continued() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sent
+}
@@ -0,0 +1,73 @@
+package yves
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// the server answers 100 Continue when the body is read
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	for _, connect := range []bool{false, true} {
+		for _, path := range []string{"/echo", "/reject"} {
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(conn)
+			target := "http://" + host + path
+			if connect {
+				// a plain HTTP connection in a CONNECT tunnel
+				fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+				if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+					t.Fatalf("CONNECT failed: %v", err)
+				}
+				target = path
+			}
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", target, host)
+
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path == "/reject" {
+				if resp.StatusCode != http.StatusUnauthorized || !resp.Close {
+					t.Errorf("Expected: 401 closing the connection, but got: %s %v", resp.Status, resp.Close)
+				}
+				conn.Close()
+				continue
+			}
+			if resp.StatusCode != http.StatusContinue {
+				t.Fatalf("Expected: 100, but got: %s", resp.Status)
+			}
+			io.WriteString(conn, "hello")
+			resp, err = http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+				t.Errorf("Expected: 200 hello, but got: %s %s", resp.Status, body)
+			}
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package yves
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// dumpRequest logs req as it is sent to the remote host, when DumpHTTP is
+// set, and makes its body logged as it is read.
+func (p *Proxy) dumpRequest(session int64, req *http.Request) {
+	if !p.DumpHTTP {
+		return
+	}
+	dump, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		p.logger().Errorf("[%d] Cannot dump the request: %v", session, err)
+		return
+	}
+	p.logger().Debugf("[%d] Request sent:\n%s", session, dump)
+	if req.Body != nil && req.Body != http.NoBody && p.DumpBodySize > 0 {
+		req.Body = p.dumpBody(session, "Request", req.Body)
+	}
+}
+
+// dumpResponse logs resp as it is received from the remote host, when
+// DumpHTTP is set, and makes its body logged as it is read.
+func (p *Proxy) dumpResponse(session int64, resp *http.Response) {
+	if !p.DumpHTTP {
+		return
+	}
+	dump, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		p.logger().Errorf("[%d] Cannot dump the response: %v", session, err)
+		return
+	}
+	p.logger().Debugf("[%d] Response received:\n%s", session, dump)
+	if resp.Body != nil && resp.Body != http.NoBody && p.DumpBodySize > 0 {
+		resp.Body = p.dumpBody(session, "Response", resp.Body)
+	}
+}
+
+// dumpBody returns body logging its first DumpBodySize bytes once they
+// have been read, or when the body ends before. The body is not read in
+// advance, so that streams are not held back.
+func (p *Proxy) dumpBody(session int64, name string, body io.ReadCloser) io.ReadCloser {
+	return &dumpedBody{ReadCloser: body, limit: p.DumpBodySize, log: func(b []byte, truncated bool) {
+		more := ""
+		if truncated {
+			more = ", truncated"
+		}
+		p.logger().Debugf("[%d] %s body (%d bytes%s):\n%s", session, name, len(b), more, printable(b))
+	}}
+}
+
+type dumpedBody struct {
+	io.ReadCloser
+	limit int64
+	log   func(b []byte, truncated bool)
+
+	buf    bytes.Buffer
+	logged sync.Once
+}
+
+func (b *dumpedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if rest := b.limit - int64(b.buf.Len()); rest > 0 {
+		if int64(n) > rest {
+			b.buf.Write(p[:rest])
+			b.flush(true)
+		} else {
+			b.buf.Write(p[:n])
+		}
+	} else if n > 0 {
+		b.flush(true)
+	}
+	if err != nil {
+		b.flush(false)
+	}
+	return n, err
+}
+
+func (b *dumpedBody) Close() error {
+	b.flush(false)
+	return b.ReadCloser.Close()
+}
+
+func (b *dumpedBody) flush(truncated bool) {
+	b.logged.Do(func() {
+		b.log(b.buf.Bytes(), truncated)
+	})
+}
+
+// printable returns b as it is if it is text, or as a hex dump otherwise.
+func printable(b []byte) string {
+	if !utf8.Valid(b) {
+		return hex.Dump(b)
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return hex.Dump(b)
+		}
+	}
+	return string(b)
+}
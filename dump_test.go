@@ -0,0 +1,82 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is written by the logger from several goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDumpHTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+
+	for _, bodySize := range []int64{0, 5, 100} {
+		var logs lockedBuffer
+		p := NewProxy()
+		p.Logger = StdLogger(log.New(&logs, "", 0), LevelDebug)
+		p.DumpHTTP = true
+		p.DumpBodySize = bodySize
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("hello world"))
+		resp, err := p.forwardReq(p.newSession(), req, upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello world" {
+			t.Errorf("Expected: hello world, but got: %q", body)
+		}
+
+		want := []string{"POST /upload HTTP/1.1\r\n", "Content-Length: 11\r\n", "HTTP/1.1 200 OK\r\n", "X-Upstream: yes\r\n"}
+		switch bodySize {
+		case 5:
+			want = append(want, "Request body (5 bytes, truncated):\nhello\n", "Response body (5 bytes, truncated):\nhello\n")
+		case 100:
+			want = append(want, "Request body (11 bytes):\nhello world\n", "Response body (11 bytes):\nhello world\n")
+		}
+		got := logs.String()
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%d: Expected %q in the logs, but got: %s", bodySize, w, got)
+			}
+		}
+		if bodySize == 0 && strings.Contains(got, "body") {
+			t.Errorf("Expected no body in the logs, but got: %s", got)
+		}
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	if got := printable([]byte("{\"a\": 1}\r\n")); got != "{\"a\": 1}\r\n" {
+		t.Errorf("Expected the text as it is, but got: %q", got)
+	}
+	if got := printable([]byte{0x1f, 0x8b, 0x08}); !strings.HasPrefix(got, "00000000  1f 8b 08") {
+		t.Errorf("Expected a hex dump, but got: %q", got)
+	}
+}
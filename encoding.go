@@ -0,0 +1,82 @@
+package yves
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentDecoder returns a reader that decodes r according to a
+// Content-Encoding.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// defaultDecoders are the content encodings supported out of the box.
+// Others, like br, can be added with Proxy.ContentDecoders.
+var defaultDecoders = map[string]ContentDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+// contentDecoder returns the decoder for encoding, if any.
+func (p *Proxy) contentDecoder(encoding string) ContentDecoder {
+	if d, ok := p.ContentDecoders[encoding]; ok {
+		return d
+	}
+	return defaultDecoders[encoding]
+}
+
+// decodeResponseBody replaces the body of resp with its decoded version,
+// removing Content-Encoding, Content-Length and the digests, and weakening
+// the ETag. The response is left untouched if the encoding is not supported.
+func (p *Proxy) decodeResponseBody(resp *http.Response) error {
+	if !p.DecodeResponseBody || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	// the transport already decoded the body, do not do it twice.
+	if resp.Uncompressed {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	decoder := p.contentDecoder(encoding)
+	if decoder == nil {
+		return nil
+	}
+	dec, err := decoder(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	resp.Body = &decodedBody{ReadCloser: dec, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	// the digests are those of the encoded body, and the ETag is only
+	// weakly equal to the one of the decoded body
+	removeDigests(resp.Header)
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	resp.Uncompressed = true
+	return nil
+}
+
+// decodedBody closes both the decoder and the original body.
+type decodedBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
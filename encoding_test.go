@@ -0,0 +1,104 @@
+package yves
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func gzipBody(s string) io.ReadCloser {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return io.NopCloser(&buf)
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	p := NewProxy()
+	p.DecodeResponseBody = true
+	var seen string
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		seen = string(body)
+		return nil
+	}
+
+	resp := &http.Response{
+		Header:        http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {"42"}, "Etag": {`"v1"`}, "Content-Md5": {"ZGVjb2RlZA=="}},
+		Body:          gzipBody("hello world"),
+		ContentLength: 42,
+	}
+	if err := p.handleResp(p.newSession(), resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "hello world" {
+		t.Errorf("Expected: %q, but got: %q", "hello world", seen)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Expected: %q, but got: %q", "hello world", body)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+		t.Errorf("Expected Content-Encoding and Content-Length to be removed, but got: %v", resp.Header)
+	}
+	// the validators of the gzipped body
+	if resp.Header.Get("ETag") != `W/"v1"` || resp.Header.Get("Content-MD5") != "" {
+		t.Errorf("Expected a weak ETag and no Content-MD5, but got: %v", resp.Header)
+	}
+}
+
+func TestDecodeResponseBodyDisabled(t *testing.T) {
+	p := NewProxy()
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   gzipBody("hello world"),
+	}
+	if err := p.decodeResponseBody(resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the response to be left encoded")
+	}
+}
+
+func TestDecodeResponseBodyUncompressed(t *testing.T) {
+	p := NewProxy()
+	p.DecodeResponseBody = true
+	// the transport already decoded the body
+	resp := &http.Response{
+		Header:       http.Header{"Content-Encoding": {"gzip"}},
+		Body:         io.NopCloser(strings.NewReader("hello world")),
+		Uncompressed: true,
+	}
+	if err := p.decodeResponseBody(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Expected: %q, but got: %q", "hello world", body)
+	}
+}
+
+func TestContentDecoders(t *testing.T) {
+	p := NewProxy()
+	p.DecodeResponseBody = true
+	p.ContentDecoders = map[string]ContentDecoder{
+		"br": func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("decoded")), nil
+		},
+	}
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"br"}},
+		Body:   io.NopCloser(strings.NewReader("encoded")),
+	}
+	if err := p.decodeResponseBody(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "decoded" {
+		t.Errorf("Expected: %q, but got: %q", "decoded", body)
+	}
+}
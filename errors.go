@@ -0,0 +1,36 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// errorStatus returns the status code to answer the client with when err
+// occurs while contacting the remote host, code if there is no better one:
+// 504 if the remote host did not answer in time, 502 if it could not be
+// reached or sent an invalid response, 413 if the request body is too large.
+func errorStatus(err error, code int) int {
+	var netErr net.Error
+	var urlErr *url.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrPrivateNetwork), errors.Is(err, ErrHostNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrTooManyRequests):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrDropped):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrRequestBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.As(err, &urlErr), errors.As(err, &opErr), errors.As(err, &dnsErr):
+		// url.Error is returned by the HTTP client only
+		return http.StatusBadGateway
+	}
+	return code
+}
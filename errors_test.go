@@ -0,0 +1,72 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrorStatus(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+	}{
+		{errors.New("internal"), http.StatusInternalServerError},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, http.StatusBadGateway},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("malformed HTTP response")}, http.StatusBadGateway},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, http.StatusBadGateway},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, http.StatusGatewayTimeout},
+		{fmt.Errorf("reading body: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{fmt.Errorf("127.0.0.1: %w", ErrPrivateNetwork), http.StatusForbidden},
+		{fmt.Errorf("admin.example.com: %w", ErrHostNotAllowed), http.StatusForbidden},
+		{ErrDropped, http.StatusBadGateway},
+	}
+	for _, tc := range testCases {
+		if result := errorStatus(tc.err, http.StatusInternalServerError); result != tc.expected {
+			t.Errorf("Expected: %d, but got: %d for %v", tc.expected, result, tc.err)
+		}
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer upstream.Close()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := "http://" + ln.Addr().String()
+	ln.Close()
+
+	p := NewProxy()
+	p.RequestTimeout = 50 * time.Millisecond
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	testCases := []struct {
+		target   string
+		expected int
+	}{
+		{upstream.URL, http.StatusGatewayTimeout},
+		{closed, http.StatusBadGateway},
+	}
+	for _, tc := range testCases {
+		resp, err := client.Get(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("Expected: %d, but got: %d", tc.expected, resp.StatusCode)
+		}
+	}
+}
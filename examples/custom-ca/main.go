@@ -19,9 +19,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	proxy := yves.NewProxy()
-	proxy.CaCert = caCert
-	proxy.CaKey = caKey
+	proxy := yves.NewProxy(yves.WithCA(caCert, caKey))
 
 	// Listen on local port 8080
 	log.Fatal(http.ListenAndServe("127.0.0.1:8080", proxy))
@@ -15,6 +15,8 @@ var forbiddenWord = "password"
 func main() {
 
 	proxy := yves.NewProxy()
+	// receive whole messages even when they are fragmented
+	proxy.ReassembleWebsocket = true
 
 	// intercept websocket fragment and if they contain forbiddenWord, replace it
 	// with a redacted version
@@ -26,9 +28,8 @@ func main() {
 			fmt.Printf("message: %s", webFrag.Data)
 			if strings.Contains(message, forbiddenWord) {
 				newMessage := strings.ReplaceAll(message, forbiddenWord, redactedForm)
-				// update message length
-				webFrag.PayloadLength = uint64(len(newMessage))
-				// replace data
+				// replace data, the length is updated when the
+				// fragment is written
 				webFrag.Data = []byte(newMessage)
 			}
 		}
@@ -0,0 +1,161 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// hostAllowed tells whether the proxy can connect to host according to
+// AllowHosts and DenyHosts. host can contain a port, which is ignored.
+func (p *Proxy) hostAllowed(host string) bool {
+	host = filterHost(host)
+	for _, pattern := range p.DenyHosts {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(p.AllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatchesAny tells whether host, which can contain a port, matches one
+// of patterns, see matchHost.
+func hostMatchesAny(patterns []string, host string) bool {
+	host = filterHost(host)
+	for _, pattern := range patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterHost returns host as it is matched against the patterns: without
+// its port, in lower case, without the brackets of an IPv6 literal nor the
+// trailing dot, e.g. evil.com. is evil.com.
+func filterHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// matchHost tells whether host matches pattern, which is either a CIDR
+// range, e.g. 10.0.0.0/8, or a glob pattern, e.g. *.example.com.
+func matchHost(pattern, host string) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	}
+	matched, err := path.Match(strings.ToLower(pattern), host)
+	return err == nil && matched
+}
+
+// forbidHost answers the client with a 403 and returns true if the proxy is
+// not allowed to connect to host.
+func (p *Proxy) forbidHost(clientConn io.Writer, host string) bool {
+	if p.hostAllowed(host) {
+		return false
+	}
+	p.logger().Infof("Connection to %s forbidden", host)
+	HttpError(clientConn, fmt.Sprintf("Access to %s is forbidden by the proxy", host), http.StatusForbidden)
+	return true
+}
+
+// ErrHostNotAllowed is returned when AllowHosts or DenyHosts forbid the
+// target given by RewriteTarget.
+var ErrHostNotAllowed = errors.New("host forbidden by the proxy")
+
+// ErrPrivateNetwork is returned when BlockPrivateNetworks forbids a
+// connection.
+var ErrPrivateNetwork = errors.New("connection to a private network forbidden")
+
+// dialPublic resolves the host of addr and dials the resolved address,
+// unless it is a private one.
+func (p *Proxy) dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.publicIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = p.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// checkPublic returns ErrPrivateNetwork if BlockPrivateNetworks is set and
+// the host of addr resolves to a private address. It is used for the
+// destinations reached through the upstream proxy, which are not dialed by
+// the proxy itself.
+func (p *Proxy) checkPublic(ctx context.Context, addr string) error {
+	if !p.BlockPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	_, err = p.publicIPs(ctx, strings.Trim(host, "[]"))
+	return err
+}
+
+// publicIPs resolves host and returns its addresses, or ErrPrivateNetwork
+// if one of them is private.
+func (p *Proxy) publicIPs(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) && !p.privateHostAllowed(host, ip) {
+			return nil, fmt.Errorf("%s (%s): %w", host, ip, ErrPrivateNetwork)
+		}
+	}
+	return ips, nil
+}
+
+func (p *Proxy) privateHostAllowed(host string, ip net.IP) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range p.AllowPrivateHosts {
+		if matchHost(pattern, host) || matchHost(pattern, ip.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateIP tells whether ip is a loopback, link-local, private or
+// unspecified address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
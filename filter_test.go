@@ -0,0 +1,236 @@
+package yves
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	testCases := []struct {
+		allow    []string
+		deny     []string
+		host     string
+		expected bool
+	}{
+		{nil, nil, "example.com:443", true},
+		{[]string{"*.example.com"}, nil, "www.example.com:443", true},
+		{[]string{"*.example.com"}, nil, "a.b.EXAMPLE.com", true},
+		{[]string{"*.example.com"}, nil, "example.com", false},
+		{[]string{"*.example.com"}, nil, "example.org:80", false},
+		{[]string{"10.0.0.0/8"}, nil, "10.1.2.3:8080", true},
+		{[]string{"10.0.0.0/8"}, nil, "192.168.1.1:8080", false},
+		{[]string{"::1/128"}, nil, "[::1]:443", true},
+		{nil, []string{"evil.com"}, "evil.com:443", false},
+		{nil, []string{"evil.com"}, "evil.com.:443", false},
+		{nil, []string{"evil.com"}, "EVIL.com.", false},
+		{[]string{"*.example.com"}, nil, "www.example.com.:443", true},
+		{nil, []string{"169.254.0.0/16"}, "169.254.169.254:80", false},
+		{[]string{"*.example.com"}, []string{"admin.example.com"}, "admin.example.com:443", false},
+	}
+	for _, tc := range testCases {
+		p := &Proxy{AllowHosts: tc.allow, DenyHosts: tc.deny}
+		if result := p.hostAllowed(tc.host); result != tc.expected {
+			t.Errorf("Expected: %v, but got: %v for %s", tc.expected, result, tc.host)
+		}
+	}
+}
+
+func TestForbiddenHosts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(upstream.Config.Handler)
+	defer tlsUpstream.Close()
+
+	p := NewProxy()
+	p.DenyHosts = []string{"127.0.0.0/8"}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected: %d, but got: %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	_, err = client.Get(tlsUpstream.URL)
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Errorf("Expected the CONNECT to be forbidden, but got: %v", err)
+	}
+
+	// a trailing dot does not make a difference
+	p.DenyHosts = []string{"localhost"}
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	resp, err = client.Get("http://localhost.:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected: %d, but got: %d", http.StatusForbidden, resp.StatusCode)
+	}
+	_, err = client.Get("https://localhost.:" + port)
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Errorf("Expected the CONNECT to be forbidden, but got: %v", err)
+	}
+
+	p.DenyHosts = nil
+	p.AllowHosts = []string{"127.0.0.1"}
+	for _, target := range []string{upstream.URL, tlsUpstream.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("Expected: hello, but got: %s", body)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", true},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tc := range testCases {
+		if result := isPrivateIP(net.ParseIP(tc.ip)); result != tc.expected {
+			t.Errorf("Expected: %v, but got: %v for %s", tc.expected, result, tc.ip)
+		}
+	}
+}
+
+func TestBlockPrivateNetworks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(upstream.Config.Handler)
+	defer tlsUpstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	p := NewProxy()
+	p.BlockPrivateNetworks = true
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	// localhost is resolved before being checked
+	for _, target := range []string{upstream.URL, "http://localhost:" + port} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected: %d, but got: %d", http.StatusForbidden, resp.StatusCode)
+		}
+	}
+	_, err := client.Get(tlsUpstream.URL)
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Errorf("Expected the CONNECT to be forbidden, but got: %v", err)
+	}
+
+	p.AllowPrivateHosts = []string{"127.0.0.1/32"}
+	for _, target := range []string{upstream.URL, tlsUpstream.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("Expected: hello, but got: %s", body)
+		}
+	}
+}
+
+func TestBlockPrivateNetworksUpstreamProxy(t *testing.T) {
+	var proxied int32
+	upstreamProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		io.WriteString(w, "proxied "+r.URL.Host)
+	}))
+	defer upstreamProxy.Close()
+
+	p := NewProxy()
+	p.BlockPrivateNetworks = true
+	// the upstream proxy runs on the loopback, it is not checked
+	proxyURL, _ := url.Parse(upstreamProxy.URL)
+	p.Tr.Proxy = http.ProxyURL(proxyURL)
+	p.AllowPrivateHosts = []string{"localhost"}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	testCases := []struct {
+		target string
+		status int
+	}{
+		// the destinations are checked instead
+		{"http://169.254.169.254/", http.StatusForbidden},
+		{"http://127.0.0.1:8080/", http.StatusForbidden},
+		{"http://localhost:8080/", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		resp, err := client.Get(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: Expected: %d, but got: %d %s", tc.target, tc.status, resp.StatusCode, body)
+		}
+	}
+	if n := atomic.LoadInt32(&proxied); n != 1 {
+		t.Errorf("Expected: 1, but got: %d", n)
+	}
+
+	// the same for the connections tunneled through the upstream proxy
+	p.Tr.Proxy = http.ProxyURL(connectProxy(t, "HTTP/1.1 200 OK\r\n\r\n"))
+	if _, err := p.dialUpstream(context.Background(), "169.254.169.254:443"); !errors.Is(err, ErrPrivateNetwork) {
+		t.Errorf("Expected: %v, but got: %v", ErrPrivateNetwork, err)
+	}
+	conn, err := p.dialUpstream(context.Background(), "localhost:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -1,10 +1,11 @@
 module github.com/rhaidiz/yves
 
-go 1.17
+go 1.18
 
 require (
 	github.com/kaitai-io/kaitai_struct_go_runtime v0.10.0
-	golang.org/x/net v0.9.0
+	golang.org/x/net v0.33.0
+	golang.org/x/time v0.3.0
 )
 
-require golang.org/x/text v0.9.0 // indirect
+require golang.org/x/text v0.21.0 // indirect
@@ -0,0 +1,287 @@
+package yves
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HarRecorder records the traffic going through a proxy in the HTTP Archive
+// format (HAR 1.2). Requests and responses are correlated with the session id
+// given to the handlers. Bodies are recorded only when they are handed to the
+// body handlers, see MaxBodyBufferSize.
+type HarRecorder struct {
+	mutex   sync.Mutex
+	entries map[int64]*harEntry
+	order   []int64
+}
+
+// NewHarRecorder returns an empty HarRecorder.
+func NewHarRecorder() *HarRecorder {
+	return &HarRecorder{entries: make(map[int64]*harEntry)}
+}
+
+// Install sets the handlers of p to the ones of the recorder, replacing the
+// existing ones. To record traffic while using other handlers, call the
+// methods of the recorder from them.
+func (h *HarRecorder) Install(p *Proxy) {
+	p.HandleRequest = h.HandleRequest
+	p.HandleRequestBody = h.HandleRequestBody
+	p.HandleResponse = h.HandleResponse
+	p.HandleResponseBody = h.HandleResponseBody
+}
+
+// HandleRequest records req and the time it has been received.
+func (h *HarRecorder) HandleRequest(session int64, req *http.Request) *http.Response {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	entry := &harEntry{
+		started:         now,
+		StartedDateTime: now.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(req),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if _, ok := h.entries[session]; !ok {
+		h.order = append(h.order, session)
+	}
+	h.entries[session] = entry
+	return nil
+}
+
+// HandleRequestBody records the body of the request.
+func (h *HarRecorder) HandleRequestBody(session int64, req *http.Request, body []byte) []byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if entry, ok := h.entries[session]; ok {
+		entry.Request.BodySize = len(body)
+		if len(body) > 0 {
+			text, _ := harText(body)
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text}
+		}
+	}
+	return nil
+}
+
+// HandleResponse records resp and the time it has been received.
+func (h *HarRecorder) HandleResponse(session int64, req *http.Request, resp *http.Response) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, ok := h.entries[session]
+	if !ok {
+		return
+	}
+	entry.waited = time.Now()
+	if t, ok := ResponseTiming(resp); ok {
+		entry.started = t.Start
+		entry.sent = t.Sent
+		entry.waited = t.Response
+	}
+	entry.received = entry.waited
+	entry.hasResponse = true
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  statusText(resp),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		Content:     harContent{Size: -1, MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+// HandleResponseBody records the body of the response.
+func (h *HarRecorder) HandleResponseBody(session int64, resp *http.Response, body []byte) []byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, ok := h.entries[session]
+	if !ok || !entry.hasResponse {
+		return nil
+	}
+	entry.received = time.Now()
+	entry.Response.BodySize = len(body)
+	entry.Response.Content.Size = len(body)
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(body)
+	return nil
+}
+
+// Write writes the recorded entries, those that have received a response,
+// to w as JSON.
+func (h *HarRecorder) Write(w io.Writer) error {
+	h.mutex.Lock()
+	har := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "yves", Version: "1.0"},
+		Entries: []harEntry{},
+	}}
+	for _, session := range h.order {
+		entry := h.entries[session]
+		if entry == nil || !entry.hasResponse {
+			continue
+		}
+		e := *entry
+		e.Timings = harTimings{
+			Blocked: -1,
+			Send:    0,
+			Wait:    ms(e.waited.Sub(e.started)),
+			Receive: ms(e.received.Sub(e.waited)),
+		}
+		if !e.sent.IsZero() {
+			// the time spent in the proxy before forwarding the request
+			e.Timings.Blocked = ms(e.sent.Sub(e.started))
+			e.Timings.Wait = ms(e.waited.Sub(e.sent))
+		}
+		e.Time = ms(e.received.Sub(e.started))
+		har.Log.Entries = append(har.Log.Entries, e)
+	}
+	h.mutex.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(har)
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	started     time.Time
+	sent        time.Time
+	waited      time.Time
+	received    time.Time
+	hasResponse bool
+
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	values := []harNameValue{}
+	for name, vv := range header {
+		for _, v := range vv {
+			values = append(values, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	values := []harNameValue{}
+	for _, c := range cookies {
+		values = append(values, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	return values
+}
+
+func harQuery(req *http.Request) []harNameValue {
+	values := []harNameValue{}
+	for name, vv := range req.URL.Query() {
+		for _, v := range vv {
+			values = append(values, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+// statusText returns the reason phrase of resp.
+func statusText(resp *http.Response) string {
+	if text := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))); text != "" {
+		return text
+	}
+	return http.StatusText(resp.StatusCode)
+}
+
+// harText returns body as text, base64 encoded if it is not valid UTF-8.
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,72 @@
+package yves
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHarRecorder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{0xff, 0xfe, 0x00})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	har := NewHarRecorder()
+	har.Install(p)
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Post(upstream.URL+"/text?q=yves", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get(upstream.URL + "/binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	if err := har.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var result harFile
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	entries := result.Log.Entries
+	if result.Log.Version != "1.2" || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, but got: %s", buf.String())
+	}
+
+	text := entries[0]
+	if text.Request.Method != "POST" || text.Request.PostData == nil || text.Request.PostData.Text != "ping" {
+		t.Errorf("Unexpected request: %+v", text.Request)
+	}
+	if len(text.Request.QueryString) != 1 || text.Request.QueryString[0] != (harNameValue{"q", "yves"}) {
+		t.Errorf("Unexpected query string: %v", text.Request.QueryString)
+	}
+	if text.Response.Status != 200 || text.Response.StatusText != "OK" || text.Response.Content.Text != "hello" || text.Response.Content.Encoding != "" {
+		t.Errorf("Unexpected response: %+v", text.Response)
+	}
+
+	binary := entries[1]
+	if binary.Response.Content.Encoding != "base64" || binary.Response.Content.Text != "//4A" || binary.Response.Content.Size != 3 {
+		t.Errorf("Unexpected binary content: %+v", binary.Response.Content)
+	}
+}
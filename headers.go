@@ -0,0 +1,97 @@
+package yves
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful only for a single connection and must not
+// be forwarded, see RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from header,
+// including the ones listed in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// acceptsTrailers tells whether the TE header lists trailers, the only
+// value of this hop-by-hop header that is forwarded.
+func acceptsTrailers(header http.Header) bool {
+	for _, v := range header.Values("Te") {
+		for _, name := range strings.Split(v, ",") {
+			// e.g. trailers;q=0.5
+			if i := strings.IndexByte(name, ';'); i >= 0 {
+				name = name[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addForwardedHeaders appends the address of the client, remoteAddr, to the
+// X-Forwarded-For and Forwarded headers, after the ones added by the
+// previous proxies if any, and sets X-Forwarded-Proto to proto, the scheme
+// used by the client.
+func addForwardedHeaders(header http.Header, remoteAddr, proto string) {
+	ip := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = h
+	}
+	node := "unknown"
+	if ip != "" {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+		} else {
+			header.Set("X-Forwarded-For", ip)
+		}
+		// IPv6 addresses are bracketed and quoted, see RFC 7239
+		// section 6.
+		switch parsed := net.ParseIP(ip); {
+		case parsed == nil:
+			node = `"` + ip + `"`
+		case parsed.To4() == nil:
+			node = `"[` + ip + `]"`
+		default:
+			node = ip
+		}
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	forwarded := "for=" + node + ";proto=" + proto
+	if prior := header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	header.Set("Forwarded", forwarded)
+}
+
+// setRequestID sets RequestIDHeader to the session of ctx in header.
+func (p *Proxy) setRequestID(ctx context.Context, header http.Header) {
+	if p.RequestIDHeader != "" {
+		header.Set(p.RequestIDHeader, strconv.FormatInt(ctx.Value("session").(int64), 10))
+	}
+}
@@ -0,0 +1,321 @@
+package yves
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "close, X-Custom")
+	header.Set("X-Custom", "foo")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Proxy-Connection", "keep-alive")
+	header.Set("Content-Type", "text/plain")
+
+	removeHopByHopHeaders(header)
+	if len(header) != 1 || header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected only Content-Type, but got: %v", header)
+	}
+}
+
+func TestProxyConnectionNotForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" || r.Header.Get("X-Custom") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "foo")
+	}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\nConnection: X-Custom\r\nX-Custom: foo\r\n\r\n",
+		upstream.URL, upstream.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected hop-by-hop headers to be removed from the request, but got: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Hop") != "" {
+		t.Errorf("Expected hop-by-hop headers to be removed from the response")
+	}
+}
+
+func TestAddForwardedHeaders(t *testing.T) {
+	var tests = []struct {
+		remoteAddr    string
+		proto         string
+		prior         http.Header
+		xForwardedFor string
+		forwarded     string
+	}{
+		{"192.0.2.1:1234", "http", http.Header{}, "192.0.2.1", "for=192.0.2.1;proto=http"},
+		{"[2001:db8::1]:1234", "https", http.Header{}, "2001:db8::1", `for="[2001:db8::1]";proto=https`},
+		{"192.0.2.1:1234", "https",
+			http.Header{"X-Forwarded-For": {"203.0.113.1"}, "Forwarded": {"for=203.0.113.1;proto=http"}},
+			"203.0.113.1, 192.0.2.1", "for=203.0.113.1;proto=http, for=192.0.2.1;proto=https"},
+		{"", "http", http.Header{}, "", "for=unknown;proto=http"},
+	}
+	for _, tc := range tests {
+		addForwardedHeaders(tc.prior, tc.remoteAddr, tc.proto)
+		if got := tc.prior.Get("X-Forwarded-For"); got != tc.xForwardedFor {
+			t.Errorf("Expected: %s, but got: %s", tc.xForwardedFor, got)
+		}
+		if got := tc.prior.Get("Forwarded"); got != tc.forwarded {
+			t.Errorf("Expected: %s, but got: %s", tc.forwarded, got)
+		}
+		if got := tc.prior.Get("X-Forwarded-Proto"); got != tc.proto {
+			t.Errorf("Expected: %s, but got: %s", tc.proto, got)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	for _, forwarded := range []bool{false, true} {
+		p.ForwardedHeaders = forwarded
+		for _, tc := range []struct {
+			url   string
+			proto string
+		}{{plain.URL, "http"}, {secure.URL, "https"}} {
+			resp, err := client.Get(tc.url)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			header := <-headers
+			if !forwarded {
+				if header.Get("X-Forwarded-For") != "" || header.Get("Forwarded") != "" {
+					t.Errorf("Expected: no forwarded headers, but got: %v", header)
+				}
+				continue
+			}
+			if got := header.Get("X-Forwarded-For"); got != "127.0.0.1" {
+				t.Errorf("Expected: 127.0.0.1, but got: %s", got)
+			}
+			if got := header.Get("X-Forwarded-Proto"); got != tc.proto {
+				t.Errorf("Expected: %s, but got: %s", tc.proto, got)
+			}
+			if got, expected := header.Get("Forwarded"), "for=127.0.0.1;proto="+tc.proto; got != expected {
+				t.Errorf("Expected: %s, but got: %s", expected, got)
+			}
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	ids := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get("X-Yves-Request-Id")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	seen := make(map[string]bool)
+	for _, header := range []string{"", "X-Yves-Request-Id"} {
+		p.RequestIDHeader = header
+		for _, tc := range []struct {
+			url string
+			h2  bool
+		}{{plain.URL, false}, {secure.URL, false}, {secure.URL, true}} {
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyUrl),
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: tc.h2,
+			}}
+			resp, err := client.Get(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			sent := <-ids
+			if header == "" {
+				if sent != "" || resp.Header.Get("X-Yves-Request-Id") != "" {
+					t.Errorf("Expected: no request id, but got: %s", sent)
+				}
+				continue
+			}
+			if sent == "" || resp.Header.Get(header) != sent {
+				t.Errorf("Expected: %s, but got: %s (%s, h2: %v)", sent, resp.Header.Get(header), tc.url, tc.h2)
+			}
+			if seen[sent] {
+				t.Errorf("Expected a new request id, but got: %s", sent)
+			}
+			seen[sent] = true
+		}
+	}
+}
+
+func TestAcceptsTrailers(t *testing.T) {
+	var tests = []struct {
+		te       []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"trailers"}, true},
+		{[]string{"gzip, Trailers"}, true},
+		{[]string{"deflate", "trailers;q=0.5"}, true},
+		{[]string{"gzip"}, false},
+	}
+	for _, tc := range tests {
+		if result := acceptsTrailers(http.Header{"Te": tc.te}); result != tc.expected {
+			t.Errorf("Expected: %v, but got: %v for %v", tc.expected, result, tc.te)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	var received http.Header
+	var te string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		received = r.Trailer
+		te = r.Header.Get("Te")
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.WriteString(w, "hello")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer upstream.Close()
+
+	proxyServer := httptest.NewServer(NewProxy())
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	var tests = []struct {
+		h2    bool
+		proto string
+	}{
+		{false, "HTTP/1.1"},
+		{true, "HTTP/2.0"},
+	}
+	for _, tc := range tests {
+		received, te = nil, ""
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyUrl),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: tc.h2,
+		}}
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL, io.NopCloser(strings.NewReader("hello")))
+		req.Header.Set("Te", "trailers")
+		req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Proto != tc.proto {
+			t.Errorf("Expected: %s, but got: %s", tc.proto, resp.Proto)
+		}
+		if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+			t.Errorf("Expected: Grpc-Status 0, but got: %v with %s", resp.Trailer, tc.proto)
+		}
+		if v := received.Get("X-Checksum"); v != "abc" {
+			t.Errorf("Expected: X-Checksum abc, but got: %v with %s", received, tc.proto)
+		}
+		if te != "trailers" {
+			t.Errorf("Expected: trailers, but got: %q with %s", te, tc.proto)
+		}
+	}
+}
+
+func TestModifyHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.StripHSTS = true
+	var order []string
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		order = append(order, "HandleRequest")
+		req.Header.Set("X-Handler", "yes")
+		return nil
+	}
+	p.ModifyRequestHeaders = func(id int64, req *http.Request) {
+		order = append(order, "ModifyRequestHeaders "+req.Header.Get("X-Handler"))
+		req.Header.Del("X-Handler")
+		req.Header.Set("X-Modified", "yes")
+	}
+	p.HandleRequestBody = func(id int64, req *http.Request, body []byte) []byte {
+		order = append(order, "HandleRequestBody "+req.Header.Get("X-Modified"))
+		return nil
+	}
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		order = append(order, "HandleResponse")
+	}
+	p.ModifyResponseHeaders = func(id int64, resp *http.Response) {
+		order = append(order, "ModifyResponseHeaders "+resp.Header.Get("Strict-Transport-Security"))
+		resp.Header.Set("Access-Control-Allow-Origin", "*")
+	}
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		order = append(order, "HandleResponseBody "+resp.Header.Get("Access-Control-Allow-Origin"))
+		return nil
+	}
+
+	resp, err := client.Post(upstream.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	expected := []string{
+		"HandleRequest",
+		"ModifyRequestHeaders yes",
+		"HandleRequestBody yes",
+		"HandleResponse",
+		// already stripped
+		"ModifyResponseHeaders ",
+		"HandleResponseBody *",
+	}
+	if strings.Join(order, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected: %q, but got: %q", expected, order)
+	}
+	if received.Get("X-Modified") != "yes" || received.Get("X-Handler") != "" {
+		t.Errorf("Expected the modified request headers, but got: %v", received)
+	}
+	if resp.Header.Get("Strict-Transport-Security") != "" || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected the modified response headers, but got: %v", resp.Header)
+	}
+}
@@ -0,0 +1,168 @@
+package yves
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// serveHTTP2 serves a client that negotiated h2 during the TLS handshake.
+// Every stream is dispatched through the same HandleRequest/HandleResponse
+// pipeline used for HTTP/1.1. clientTLS is the state of the TLS connection
+// with the client.
+func (p *Proxy) serveHTTP2(clientConn net.Conn, destinationHost string, clientTLS *tls.ConnectionState) {
+	server := &http2.Server{}
+	addr := destinationAddr(destinationHost)
+	server.ServeConn(clientConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.TLS = clientTLS
+			if wait := p.rateLimited(req.RemoteAddr, addr); wait > 0 {
+				p.logger().Infof("Too many requests from %s to %s", req.RemoteAddr, addr)
+				tooManyRequests(w, wait)
+				return
+			}
+			if isExtendedConnect(req) {
+				p.serveHTTP2Websocket(w, req)
+				return
+			}
+			ctx, reqClone := p.scopeRequest(p.newSession(), req, destinationHost)
+
+			resp, err := p.forwardReq(ctx, req, destinationHost)
+			if errors.Is(err, ErrConnectionReset) {
+				// the stream is reset, the other ones go on
+				panic(http.ErrAbortHandler)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := p.handleResp(ctx, resp, reqClone); err != nil {
+				http.Error(w, err.Error(), errorStatus(err, http.StatusBadGateway))
+				return
+			}
+			p.setRequestID(ctx, resp.Header)
+			writeResponse(w, resp)
+		}),
+	})
+}
+
+// serveHTTP2Websocket serves a websocket opened by an extended CONNECT,
+// see RFC 8441. The server is asked to upgrade a HTTP/1.1 connection
+// instead: the :protocol pseudo-header becomes the Upgrade header, the
+// subprotocol and the extensions are negotiated as usual and the 101 of the
+// server becomes a 200 without Sec-WebSocket-Accept. The frames are the
+// same over both protocols, they are handled as any other websocket.
+func (p *Proxy) serveHTTP2Websocket(w http.ResponseWriter, req *http.Request) {
+	ctx := p.newSession()
+	if p.outOfScope(req) {
+		ctx = context.WithValue(ctx, outOfScopeKey{}, true)
+	}
+	host := websocketAddr(req.Host, true)
+	if !p.hostAllowed(host) {
+		p.logger().Infof("Connection to %s forbidden", host)
+		http.Error(w, "Access to "+host+" is forbidden by the proxy", http.StatusForbidden)
+		return
+	}
+	ctx = context.WithValue(ctx, websocketHostKey{}, host)
+
+	targetConn, err := p.connectDial(ctx, "tcp", host, true)
+	if err != nil {
+		p.logger().Errorf("Proxy connect dial error: %v", err)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	defer targetConn.Close()
+	if tlsConn, ok := targetConn.(*tls.Conn); ok && inScope(ctx) {
+		state := tlsConn.ConnectionState()
+		p.handleUpstreamTLS(ctx, &state)
+	}
+
+	header, compressed, err := p.upgradeWebsocket(req, targetConn)
+	if err != nil {
+		p.logger().Errorf("Websocket handshake error: %v", err)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	p.logger().Debugf("Websocket handshake with %s completed over HTTP/2", host)
+
+	p.proxyWebsocket(ctx, targetConn, &http2Stream{body: req.Body, w: w}, compressed)
+}
+
+// http2Stream is the stream of an extended CONNECT, read from the request
+// body and written to the response. Nothing is written once it is closed,
+// the response cannot be used after the handler returns.
+type http2Stream struct {
+	body   io.ReadCloser
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	closed bool
+}
+
+func (s *http2Stream) Read(b []byte) (int, error) {
+	return s.body.Read(b)
+}
+
+func (s *http2Stream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := s.w.Write(b)
+	s.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func (s *http2Stream) Close() error {
+	err := s.body.Close()
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return err
+}
+
+// writeResponse copies resp to a http.ResponseWriter, followed by its
+// trailers.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	// connection specific headers are not allowed in HTTP/2 responses.
+	removeHopByHopHeaders(w.Header())
+	w.WriteHeader(resp.StatusCode)
+	// the http2 ResponseWriter is buffered, flush it after every write
+	// so that streamed responses reach the client in real time.
+	if f, ok := w.(http.Flusher); ok {
+		io.Copy(flushWriter{w: w, f: f}, resp.Body)
+	} else {
+		io.Copy(w, resp.Body)
+	}
+	// the values of the trailers are known once the body has been read
+	for k, v := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
@@ -0,0 +1,178 @@
+package yves
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// ErrDropped is returned when an intercepted request or response is
+// dropped, the client gets a 502.
+var ErrDropped = errors.New("dropped by the proxy")
+
+// InterceptedItem is a request, or a response, held by the proxy until
+// one of Forward, Drop or Edit is called, only once. See Proxy.Intercepted.
+type InterceptedItem struct {
+	Session int64
+	// Request is the intercepted request, or the request of the
+	// intercepted response.
+	Request *http.Request
+	// Response is the intercepted response, nil for requests.
+	Response *http.Response
+
+	once    sync.Once
+	verdict chan error
+}
+
+// Forward sends the request, or the response, along with the changes made
+// to Request or Response.
+func (i *InterceptedItem) Forward() {
+	i.resolve(nil)
+}
+
+// Drop drops the request, or the response, the client gets a 502 instead.
+func (i *InterceptedItem) Drop() {
+	i.resolve(ErrDropped)
+}
+
+// Edit replaces the request, or the response, with raw, which is parsed as
+// an HTTP/1.1 message, e.g. an edited version of the one returned by Dump,
+// and forwards it. The item is still pending if raw cannot be parsed.
+// Content-Length is fixed to match the body, unless the body is chunked.
+// The destination of a request is kept when raw does not have an absolute
+// URL.
+func (i *InterceptedItem) Edit(raw []byte) error {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	if i.Response == nil {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return err
+		}
+		if req.URL.Host == "" {
+			req.URL.Host = i.Request.URL.Host
+		}
+		if req.URL.Scheme == "" {
+			req.URL.Scheme = i.Request.URL.Scheme
+		}
+		req.RequestURI = ""
+		if len(req.TransferEncoding) == 0 {
+			req.Body, req.ContentLength = setBody(req.Header, rawBody(raw))
+		}
+		i.Request.Body.Close()
+		i.Request = req.WithContext(i.Request.Context())
+	} else {
+		resp, err := http.ReadResponse(r, i.Request)
+		if err != nil {
+			return err
+		}
+		if len(resp.TransferEncoding) == 0 && i.Request.Method != http.MethodHead {
+			resp.Body, resp.ContentLength = setBody(resp.Header, rawBody(raw))
+		}
+		i.Response.Body.Close()
+		*i.Response = *resp
+	}
+	i.resolve(nil)
+	return nil
+}
+
+// rawBody returns what follows the headers of the HTTP message raw.
+func rawBody(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[i+4:]
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[i+2:]
+	}
+	return nil
+}
+
+// Dump returns the request, or the response, in its HTTP/1.1 wire
+// representation, including the body.
+func (i *InterceptedItem) Dump() ([]byte, error) {
+	if i.Response == nil {
+		return httputil.DumpRequest(i.Request, true)
+	}
+	return httputil.DumpResponse(i.Response, true)
+}
+
+func (i *InterceptedItem) resolve(err error) {
+	i.once.Do(func() {
+		i.verdict <- err
+	})
+}
+
+// Intercepted returns the channel on which the requests and the responses
+// selected by InterceptRequest and InterceptResponse are sent. They are held
+// until they are handled, so the channel must be read as long as they are
+// set.
+func (p *Proxy) Intercepted() <-chan *InterceptedItem {
+	return p.interceptedChan()
+}
+
+func (p *Proxy) interceptedChan() chan *InterceptedItem {
+	p.interceptedOnce.Do(func() {
+		p.intercepted = make(chan *InterceptedItem)
+	})
+	return p.intercepted
+}
+
+// intercept queues item and waits for it to be handled.
+func (p *Proxy) intercept(item *InterceptedItem) error {
+	item.verdict = make(chan error, 1)
+	select {
+	case p.interceptedChan() <- item:
+	case <-p.shutdownSignal():
+		return ErrProxyClosed
+	}
+	select {
+	case err := <-item.verdict:
+		return err
+	case <-p.shutdownSignal():
+		return ErrProxyClosed
+	}
+}
+
+// interceptRequest holds req if InterceptRequest selects it, and returns
+// the request to forward.
+func (p *Proxy) interceptRequest(session int64, req *http.Request) (*http.Request, error) {
+	if p.InterceptRequest == nil || !p.InterceptRequest(session, req) {
+		return req, nil
+	}
+	item := &InterceptedItem{Session: session, Request: req}
+	if err := p.intercept(item); err != nil {
+		return nil, err
+	}
+	return item.Request, nil
+}
+
+// interceptResponse holds resp, the response to req, if InterceptResponse
+// selects it, and tells whether it was held. The body is read in memory
+// first, so that the response does not time out while it is held.
+// Streamed responses and the bodies larger than MaxBodyBufferSize are not
+// held, they are forwarded untouched.
+func (p *Proxy) interceptResponse(session int64, req *http.Request, resp *http.Response) (bool, error) {
+	if p.InterceptResponse == nil || !p.InterceptResponse(session, resp) {
+		return false, nil
+	}
+	if p.isStreaming(session, resp) {
+		p.logger().Debugf("[%d] Not intercepting the streamed response", session)
+		return false, nil
+	}
+	if req.Method != http.MethodHead {
+		body, rest, ok, err := bufferBody(resp.Body, p.maxBodyBufferSize())
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			p.logger().Debugf("[%d] Not intercepting the response, the body is too large", session)
+			resp.Body = rest
+			return false, nil
+		}
+		resp.Body, resp.ContentLength = setBody(resp.Header, body)
+		resp.TransferEncoding = nil
+	}
+	return true, p.intercept(&InterceptedItem{Session: session, Request: req, Response: resp})
+}
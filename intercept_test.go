@@ -0,0 +1,133 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIntercept(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.URL.Path+" "+r.Header.Get("X-Edited")+" "+string(body))
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.InterceptRequest = func(session int64, req *http.Request) bool {
+		return req.URL.Path != "/response"
+	}
+	p.InterceptResponse = func(session int64, resp *http.Response) bool {
+		return resp.Request.URL.Path == "/response"
+	}
+
+	testCases := []struct {
+		path     string
+		handle   func(*InterceptedItem) error
+		status   int
+		expected string
+	}{
+		{"/forward", func(item *InterceptedItem) error {
+			item.Request.Header.Set("X-Edited", "yes")
+			item.Forward()
+			return nil
+		}, http.StatusOK, "/forward yes "},
+		{"/edit", func(item *InterceptedItem) error {
+			raw, err := item.Dump()
+			if err != nil {
+				return err
+			}
+			raw = bytes.Replace(raw, []byte("/edit"), []byte("/edited"), 1)
+			return item.Edit(append(raw, "new body"...))
+		}, http.StatusOK, "/edited  new body"},
+		{"/drop", func(item *InterceptedItem) error {
+			item.Drop()
+			return nil
+		}, http.StatusBadGateway, ErrDropped.Error()},
+		{"/response", func(item *InterceptedItem) error {
+			if item.Response == nil || item.Request.URL.Path != "/response" {
+				t.Errorf("Expected the response to /response")
+			}
+			raw, err := item.Dump()
+			if err != nil {
+				return err
+			}
+			return item.Edit(bytes.Replace(raw, []byte("/response"), []byte("edited response"), 1))
+		}, http.StatusOK, "edited response  "},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- tc.handle(<-p.Intercepted())
+			}()
+			resp, err := client.Get(upstream.URL + tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err := <-errChan; err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status || !strings.Contains(string(body), tc.expected) {
+				t.Errorf("Expected: %d %q, but got: %d %q", tc.status, tc.expected, resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestInterceptEditInvalid(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	item := &InterceptedItem{Request: req, verdict: make(chan error, 1)}
+	if err := item.Edit([]byte("not http")); err == nil {
+		t.Errorf("Expected an error")
+	}
+	select {
+	case <-item.verdict:
+		t.Errorf("Expected the item to be still pending")
+	default:
+	}
+}
+
+func TestInterceptResponseNotHeld(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		io.WriteString(w, strings.Repeat("a", 100))
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.MaxBodyBufferSize = 10
+	p.InterceptResponse = func(session int64, resp *http.Response) bool {
+		return true
+	}
+	go func() {
+		for item := range p.Intercepted() {
+			t.Errorf("Expected no response to be held, but got: %s", item.Request.URL.Path)
+			item.Forward()
+		}
+	}()
+
+	for _, path := range []string{"/large", "/stream"} {
+		resp, err := client.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != strings.Repeat("a", 100) {
+			t.Errorf("Expected: %q, but got: %q", strings.Repeat("a", 100), body)
+		}
+		if path == "/large" && resp.ContentLength != 100 {
+			t.Errorf("Expected: %d, but got: %d", 100, resp.ContentLength)
+		}
+	}
+}
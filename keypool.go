@@ -0,0 +1,104 @@
+package yves
+
+import (
+	"crypto"
+	"sync"
+	"sync/atomic"
+)
+
+// keyPool keeps keys for the generated certificates, generated in advance
+// in the background, so that generating a certificate only costs the
+// signature.
+type keyPool struct {
+	keyType KeyType
+	keys    chan crypto.Signer
+	// filling is 1 while a goroutine fills the pool.
+	filling int32
+	// done is closed once the pool must no longer be filled.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newKeyPool returns a pool of size keys of type keyType, which must not be
+// KeyAuto. The pool is filled once the first key is taken.
+func newKeyPool(keyType KeyType, size int) *keyPool {
+	return &keyPool{keyType: keyType, keys: make(chan crypto.Signer, size), done: make(chan struct{})}
+}
+
+// stop stops filling the pool, the keys already generated can still be
+// taken.
+func (kp *keyPool) stop() {
+	kp.stopOnce.Do(func() { close(kp.done) })
+}
+
+func (kp *keyPool) stopped() bool {
+	select {
+	case <-kp.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// get takes a key from the pool, or generates one if the pool is empty,
+// and has the pool filled again in the background.
+func (kp *keyPool) get() (crypto.Signer, error) {
+	defer kp.fill()
+	select {
+	case key := <-kp.keys:
+		return key, nil
+	default:
+		return generateKey(kp.keyType, nil)
+	}
+}
+
+// fill generates the missing keys in the background, one at a time so that
+// the handshakes going on are not slowed down too much.
+func (kp *keyPool) fill() {
+	if len(kp.keys) == cap(kp.keys) || kp.stopped() || !atomic.CompareAndSwapInt32(&kp.filling, 0, 1) {
+		return
+	}
+	go func() {
+		for len(kp.keys) < cap(kp.keys) && !kp.stopped() {
+			key, err := generateKey(kp.keyType, nil)
+			if err != nil {
+				atomic.StoreInt32(&kp.filling, 0)
+				return
+			}
+			// only this goroutine adds keys, there is room
+			kp.keys <- key
+		}
+		atomic.StoreInt32(&kp.filling, 0)
+		// a key may have been taken before filling was reset
+		kp.fill()
+	}()
+}
+
+// leafKeyPool returns the pool of keys of type keyType, creating it the
+// first time or if LeafKeyPoolSize changed. There is a pool per type, which
+// changes from a host to the other with MirrorUpstream. It is called with
+// certMutex held.
+func (p *Proxy) leafKeyPool(keyType KeyType) *keyPool {
+	pool := p.keyPools[keyType]
+	if pool != nil && cap(pool.keys) == p.LeafKeyPoolSize {
+		return pool
+	}
+	if pool != nil {
+		pool.stop()
+	}
+	if p.keyPools == nil {
+		p.keyPools = make(map[KeyType]*keyPool)
+	}
+	pool = newKeyPool(keyType, p.LeafKeyPoolSize)
+	p.keyPools[keyType] = pool
+	return pool
+}
+
+// stopKeyPools stops filling the pools of keys.
+func (p *Proxy) stopKeyPools() {
+	p.certMutex.Lock()
+	defer p.certMutex.Unlock()
+	for _, pool := range p.keyPools {
+		pool.stop()
+	}
+}
@@ -0,0 +1,65 @@
+package yves
+
+import (
+	"log"
+)
+
+// Logger is used by the proxy to log what happens while serving clients.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// LogLevel is the minimum level of the messages logged by a StdLogger.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelError
+)
+
+// StdLogger returns a Logger writing the messages of at least level to l.
+func StdLogger(l *log.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func (s *stdLogger) logf(level LogLevel, prefix, format string, v ...interface{}) {
+	if level < s.level {
+		return
+	}
+	s.l.Printf(prefix+format, v...)
+}
+
+func (s *stdLogger) Debugf(format string, v ...interface{}) {
+	s.logf(LevelDebug, "[DEBUG] ", format, v...)
+}
+
+func (s *stdLogger) Infof(format string, v ...interface{}) {
+	s.logf(LevelInfo, "[INFO] ", format, v...)
+}
+
+func (s *stdLogger) Errorf(format string, v ...interface{}) {
+	s.logf(LevelError, "[ERROR] ", format, v...)
+}
+
+// nopLogger discards every message, it is the default Logger.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// logger returns the Logger of the proxy.
+func (p *Proxy) logger() Logger {
+	if p.Logger == nil {
+		return nopLogger{}
+	}
+	return p.Logger
+}
@@ -0,0 +1,34 @@
+package yves
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0), LevelInfo)
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Errorf("error %d", 3)
+
+	expected := "[INFO] info 2\n[ERROR] error 3\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q, but got: %q", expected, buf.String())
+	}
+}
+
+func TestProxyDefaultLogger(t *testing.T) {
+	p := NewProxy()
+	if _, ok := p.logger().(nopLogger); !ok {
+		t.Errorf("Expected the default logger to discard messages")
+	}
+	var buf bytes.Buffer
+	p.Logger = StdLogger(log.New(&buf, "", 0), LevelDebug)
+	p.logger().Debugf("hello")
+	if !strings.Contains(buf.String(), "hello") {
+		t.Errorf("Expected the configured logger to be used")
+	}
+}
@@ -0,0 +1,42 @@
+package yves
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Option configures a Proxy created by NewProxy. The same options can be
+// used to create several proxies configured alike.
+type Option func(*Proxy)
+
+// WithCA makes the proxy sign the certificates with the CA in certPEM and
+// keyPEM, see CaCert and CaKey.
+func WithCA(certPEM, keyPEM []byte) Option {
+	return func(p *Proxy) {
+		p.CaCert = certPEM
+		p.CaKey = keyPEM
+	}
+}
+
+// WithDialTimeout sets DialTimeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.DialTimeout = timeout
+	}
+}
+
+// WithUpstreamProxy sends all the requests through the HTTP or SOCKS5 proxy
+// at proxyURL, see Tr.Proxy.
+func WithUpstreamProxy(proxyURL *url.URL) Option {
+	return func(p *Proxy) {
+		p.Tr.Proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+// WithLogger sets Logger.
+func WithLogger(logger Logger) Option {
+	return func(p *Proxy) {
+		p.Logger = logger
+	}
+}
@@ -0,0 +1,75 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewProxyOptions(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCA("test CA", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := StdLogger(log.New(io.Discard, "", 0), LevelDebug)
+	upstream, _ := url.Parse("http://127.0.0.1:8081")
+
+	p := NewProxy(WithCA(certPEM, keyPEM), WithDialTimeout(time.Second), WithUpstreamProxy(upstream), WithLogger(logger))
+	if !bytes.Equal(p.CaCert, certPEM) || !bytes.Equal(p.CaKey, keyPEM) {
+		t.Errorf("Expected the CA to be set")
+	}
+	if p.DialTimeout != time.Second {
+		t.Errorf("Expected: %v, but got: %v", time.Second, p.DialTimeout)
+	}
+	if u := p.upstreamProxy(httpsRequest("example.com:443")); u == nil || u.String() != upstream.String() {
+		t.Errorf("Expected: %v, but got: %v", upstream, u)
+	}
+	if p.Logger != logger {
+		t.Errorf("Expected the logger to be set")
+	}
+	// the defaults are kept
+	if p.RequestTimeout != DefaultRequestTimeout || p.HttpClient.Transport != p.Tr {
+		t.Errorf("Expected the default settings to be kept")
+	}
+
+	p = NewProxy()
+	if !bytes.Equal(p.CaCert, caCert) || p.Tr.Proxy != nil {
+		t.Errorf("Expected the default CA and no upstream proxy")
+	}
+}
+
+func TestWithUpstreamProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	var traversed int64
+	endProxy, _, cleanup := NewTestProxy(t)
+	defer cleanup()
+	endProxy.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		atomic.AddInt64(&traversed, 1)
+		return nil
+	}
+
+	// the same options configure both start proxies
+	opts := []Option{WithUpstreamProxy(&url.URL{Scheme: "http", Host: endProxy.Addr().String()})}
+	for i := 0; i < 2; i++ {
+		startProxy := httptest.NewServer(NewProxy(opts...))
+		defer startProxy.Close()
+		proxyURL, _ := url.Parse(startProxy.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt64(&traversed); n != 2 {
+		t.Errorf("Expected: 2, but got: %d", n)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package yves
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was
+// redirected by iptables. Only IPv4 is supported.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// the option returns a sockaddr_in, which fits in an IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		a := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(a[4], a[5], a[6], a[7]),
+			Port: int(a[2])<<8 | int(a[3]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
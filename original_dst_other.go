@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package yves
+
+import "net"
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentUnsupported
+}
@@ -0,0 +1,144 @@
+package yves
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket per client IP or per remote host: Rate
+// requests per second are allowed, with bursts of up to Burst requests.
+type RateLimit struct {
+	// Rate is the number of requests per second, it must be positive.
+	Rate float64
+	// Burst is the number of requests allowed at once, at least 1.
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+func (l *RateLimit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// reserve takes a token from the bucket of key, the returned reservation
+// tells how long to wait for it.
+func (l *RateLimit) reserve(key string, now time.Time) *rate.Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evict(now)
+	b := l.buckets[key]
+	if b == nil {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*bucket)
+		}
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.Rate), l.burst())}
+		l.buckets[key] = b
+	}
+	b.used = now
+	return b.limiter.ReserveN(now, 1)
+}
+
+// evict removes, at most once a minute, the buckets that have not been
+// used for long enough to be full again, they are the same as new ones.
+func (l *RateLimit) evict(now time.Time) {
+	if l.Rate <= 0 || now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	idle := time.Duration(float64(l.burst()) / l.Rate * float64(time.Second))
+	if idle < time.Minute {
+		idle = time.Minute
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.used) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimited returns how long the client at remoteAddr must wait before
+// sending a request to addr again, zero if the request is allowed by
+// ClientRateLimit and HostRateLimit.
+func (p *Proxy) rateLimited(remoteAddr, addr string) time.Duration {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	if p.ClientRateLimit != nil {
+		ip := remoteAddr
+		if h, _, err := net.SplitHostPort(ip); err == nil {
+			ip = h
+		}
+		reservations = append(reservations, p.ClientRateLimit.reserve(ip, now))
+	}
+	if p.HostRateLimit != nil {
+		reservations = append(reservations, p.HostRateLimit.reserve(addr, now))
+	}
+	var wait time.Duration
+	for _, r := range reservations {
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		// the request is refused, it must not use the tokens
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	return wait
+}
+
+// requestAddr returns the address of the remote host of req, a CONNECT or a
+// request with an absolute URL, with the default port if missing.
+func requestAddr(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return strings.ToLower(hostPort(req.RequestURI, "443"))
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return strings.ToLower(websocketAddr(host, req.URL.Scheme == "https"))
+}
+
+// destinationAddr returns the address of destinationHost, the scheme and
+// the host the requests of a connection are sent to, like requestAddr.
+func destinationAddr(destinationHost string) string {
+	u, err := url.Parse(destinationHost)
+	if err != nil {
+		return strings.ToLower(destinationHost)
+	}
+	return strings.ToLower(websocketAddr(u.Host, u.Scheme == "https"))
+}
+
+// tooManyRequests answers with a 429 telling the client to retry after wait.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// writeTooManyRequests is tooManyRequests for the requests read from conn,
+// close tells whether the client must close the connection.
+func writeTooManyRequests(conn io.Writer, wait time.Duration, close bool) {
+	rsp := errorResponse(http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests, close)
+	rsp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	rsp.Write(conn)
+}
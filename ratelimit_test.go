@@ -0,0 +1,127 @@
+package yves
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.ClientRateLimit = &RateLimit{Rate: 0.5, Burst: 2}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%d: Expected: %d, but got: %d", i, want, resp.StatusCode)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected: 2, but got: %q", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// the CONNECT are limited the same way
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	var code int
+	fmt.Fscanf(conn, "HTTP/1.1 %d", &code)
+	if code != http.StatusTooManyRequests {
+		t.Errorf("Expected: %d, but got: %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestRateLimitInTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p, _, cleanup := NewTestProxy(t)
+	defer cleanup()
+	// the CONNECT and two requests
+	p.ClientRateLimit = &RateLimit{Rate: 0.5, Burst: 3}
+	host := upstream.Listener.Addr().String()
+	conn, r := connectTunnel(t, p.Addr().String(), host)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%d: Expected: %d, but got: %d", i, want, resp.StatusCode)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected: 2, but got: %q", resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestHostRateLimit(t *testing.T) {
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer limited.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.HostRateLimit = &RateLimit{Rate: 0.1, Burst: 1}
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{limited.URL, http.StatusOK},
+		{limited.URL, http.StatusTooManyRequests},
+		{other.URL, http.StatusOK},
+	} {
+		resp, err := client.Get(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: Expected: %d, but got: %d", tc.url, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	l := &RateLimit{Rate: 1, Burst: 1}
+	now := time.Now()
+	if d := l.reserve("a", now).DelayFrom(now); d != 0 {
+		t.Errorf("Expected: 0, but got: %v", d)
+	}
+	r := l.reserve("a", now)
+	if d := r.DelayFrom(now); d != time.Second {
+		t.Errorf("Expected: %v, but got: %v", time.Second, d)
+	}
+	// the refused requests do not use the tokens
+	r.CancelAt(now)
+	if d := l.reserve("a", now.Add(time.Second)).DelayFrom(now.Add(time.Second)); d != 0 {
+		t.Errorf("Expected: 0, but got: %v", d)
+	}
+
+	// the idle buckets are evicted
+	l.reserve("b", now.Add(time.Second))
+	l.reserve("c", now.Add(2*time.Minute))
+	if len(l.buckets) != 1 || l.buckets["c"] == nil {
+		t.Errorf("Expected only the last bucket to be kept, but got: %v", l.buckets)
+	}
+}
@@ -0,0 +1,135 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// DefaultRetryBackoff is the wait before the first retry when
+// RetryPolicy.Backoff is zero.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// RetryPolicy makes the proxy send again the idempotent requests, GET, HEAD,
+// PUT, DELETE, OPTIONS and TRACE, that failed because of a transient error,
+// e.g. a connection reset by the remote host or a temporary DNS failure.
+// The wait between two attempts starts at Backoff and doubles at each retry.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is sent again after the
+	// first attempt.
+	MaxRetries int
+	// Backoff is the wait before the first retry, DefaultRetryBackoff if
+	// zero.
+	Backoff time.Duration
+	// MaxBackoff caps the wait between two retries, no cap if zero.
+	MaxBackoff time.Duration
+}
+
+// wait returns the wait before the retry number n, starting from 0.
+func (r *RetryPolicy) wait(n int) time.Duration {
+	d := r.Backoff
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := 0; i < n; i++ {
+		if r.MaxBackoff > 0 && d >= r.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isTransient tells whether err is worth a retry: the connection was reset,
+// refused or closed before the response, or the name of the host could not
+// be resolved for now. Timeouts are not retried, they already took the
+// time of the request.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTemporary && !dnsErr.IsTimeout
+	}
+	return false
+}
+
+// rewindBody makes the body of req readable again for the retries. Bodies
+// that do not fit in MaxBodyBufferSize are forwarded as they are and the
+// request is not retried.
+func (p *Proxy) rewindBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true, nil
+	}
+	body, rest, ok, err := bufferBody(req.Body, p.maxBodyBufferSize())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		req.Body = rest
+		return false, nil
+	}
+	req.Body, req.ContentLength = setBody(req.Header, body)
+	// a chunked body is sent with its Content-Length instead
+	req.TransferEncoding = nil
+	req.GetBody = func() (io.ReadCloser, error) {
+		b, _ := setBody(http.Header{}, body)
+		return b, nil
+	}
+	return true, nil
+}
+
+// doRequest sends req to the remote host, again following RetryPolicy if
+// it fails with a transient error. The retries stop when the context of
+// req is done.
+func (p *Proxy) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	policy := p.RetryPolicy
+	if policy == nil || policy.MaxRetries <= 0 || !isIdempotent(req.Method) {
+		return p.HttpClient.Do(req)
+	}
+	if ok, err := p.rewindBody(req); err != nil {
+		return nil, err
+	} else if !ok {
+		return p.HttpClient.Do(req)
+	}
+	for n := 0; ; n++ {
+		resp, err := p.HttpClient.Do(req)
+		if err == nil || n >= policy.MaxRetries || !isTransient(err) {
+			return resp, err
+		}
+		wait := policy.wait(n)
+		p.logger().Debugf("[%d] Retrying %s %s in %v: %v", ctx.Value("session"), req.Method, req.URL, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
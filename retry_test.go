@@ -0,0 +1,118 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer closes the connection without answering the first failures
+// requests, then echoes the body of the requests.
+func flakyServer(failures int64) (*httptest.Server, *int64) {
+	var attempts int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt64(&attempts, 1) <= failures {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write(body)
+	}))
+	return s, &attempts
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		policy   *RetryPolicy
+		failures int64
+		wantErr  bool
+		attempts int64
+	}{
+		{"no policy", "GET", "", nil, 1, true, 1},
+		{"GET", "GET", "", &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}, 2, false, 3},
+		{"too many failures", "GET", "", &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}, 3, true, 3},
+		{"PUT with a body", "PUT", "hello", &RetryPolicy{MaxRetries: 1, Backoff: time.Millisecond}, 1, false, 2},
+		{"POST", "POST", "hello", &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}, 1, true, 1},
+	}
+	for _, tt := range tests {
+		upstream, attempts := flakyServer(tt.failures)
+		p := NewProxy()
+		p.RetryPolicy = tt.policy
+		req, _ := http.NewRequest(tt.method, "/", io.NopCloser(strings.NewReader(tt.body)))
+		// like the requests read from the clients
+		req.GetBody = nil
+		resp, err := p.forwardReq(p.newSession(), req, upstream.URL)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Expected error: %v, but got: %v", tt.name, tt.wantErr, err)
+		}
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.body {
+				t.Errorf("%s: Expected: %q, but got: %q", tt.name, tt.body, body)
+			}
+		}
+		if n := atomic.LoadInt64(attempts); n != tt.attempts {
+			t.Errorf("%s: Expected: %d attempts, but got: %d", tt.name, tt.attempts, n)
+		}
+		upstream.Close()
+	}
+}
+
+func TestRetryTimeout(t *testing.T) {
+	upstream, attempts := flakyServer(100)
+	defer upstream.Close()
+	p := NewProxy()
+	p.RequestTimeout = 100 * time.Millisecond
+	p.RetryPolicy = &RetryPolicy{MaxRetries: 100, Backoff: 20 * time.Millisecond}
+	req, _ := http.NewRequest("GET", "/", nil)
+	start := time.Now()
+	if _, err := p.forwardReq(p.newSession(), req, upstream.URL); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the retries to stop with the timeout, but took: %v", d)
+	}
+	if n := atomic.LoadInt64(attempts); n < 2 || n > 10 {
+		t.Errorf("Expected a few attempts, but got: %d", n)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	r := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for n, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := r.wait(n); got != want*time.Millisecond {
+			t.Errorf("Expected: %v, but got: %v", want*time.Millisecond, got)
+		}
+	}
+	if got := (&RetryPolicy{}).wait(0); got != DefaultRetryBackoff {
+		t.Errorf("Expected: %v, but got: %v", DefaultRetryBackoff, got)
+	}
+}
+
+func TestRewindChunkedBody(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://example.com/", io.NopCloser(strings.NewReader("hello")))
+	req.TransferEncoding = []string{"chunked"}
+	req.ContentLength = -1
+	p := NewProxy()
+	if ok, err := p.rewindBody(req); !ok || err != nil {
+		t.Fatalf("Expected the body to be rewound, but got: %v %v", ok, err)
+	}
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sent := buf.String()
+	if strings.Contains(sent, "Transfer-Encoding") || !strings.Contains(sent, "Content-Length: 5\r\n") {
+		t.Errorf("Expected only a Content-Length, but got: %q", sent)
+	}
+}
@@ -0,0 +1,145 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RuleTarget tells whether a MatchReplaceRule applies to requests or
+// responses.
+type RuleTarget int
+
+const (
+	RuleRequest RuleTarget = iota
+	RuleResponse
+)
+
+// RulePart is the part of a request or a response a MatchReplaceRule is
+// applied to.
+type RulePart int
+
+const (
+	// RuleHeader rules are applied to every header line, e.g.
+	// "User-Agent: curl/7.79.1". A line replaced with an empty string is
+	// removed.
+	RuleHeader RulePart = iota
+	// RuleBody rules are applied to the bodies handed to the body handlers
+	// and to the websocket messages going in the same direction, from the
+	// client for requests and from the server for responses.
+	RuleBody
+	// RuleURL rules are applied to the whole URL of the requests.
+	RuleURL
+)
+
+// MatchReplaceRule replaces the matches of the regular expression Match
+// with Replace, which can refer to the capture groups with $1 or ${name}.
+type MatchReplaceRule struct {
+	Target  RuleTarget
+	Part    RulePart
+	Match   string
+	Replace string
+	// Hosts limits the rule to the hosts matching one of these glob
+	// patterns or CIDR ranges, see AllowHosts. Empty means every host.
+	Hosts []string
+
+	re *regexp.Regexp
+}
+
+// AddRule adds a match and replace rule to the proxy. The rules are applied
+// in the order they are added, after the handlers.
+func (p *Proxy) AddRule(rule MatchReplaceRule) error {
+	if rule.Part == RuleURL && rule.Target != RuleRequest {
+		return errors.New("URL rules only apply to requests")
+	}
+	re, err := regexp.Compile(rule.Match)
+	if err != nil {
+		return err
+	}
+	rule.re = re
+	rule.Hosts = append([]string(nil), rule.Hosts...)
+	p.rulesMutex.Lock()
+	defer p.rulesMutex.Unlock()
+	p.rules = append(p.rules, &rule)
+	return nil
+}
+
+// ClearRules removes all the match and replace rules.
+func (p *Proxy) ClearRules() {
+	p.rulesMutex.Lock()
+	defer p.rulesMutex.Unlock()
+	p.rules = nil
+}
+
+// matchingRules returns the rules for target and part that apply to host.
+func (p *Proxy) matchingRules(target RuleTarget, part RulePart, host string) []*MatchReplaceRule {
+	p.rulesMutex.RLock()
+	defer p.rulesMutex.RUnlock()
+	var rules []*MatchReplaceRule
+	for _, rule := range p.rules {
+		if rule.Target == target && rule.Part == part && rule.appliesTo(host) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (r *MatchReplaceRule) appliesTo(host string) bool {
+	return len(r.Hosts) == 0 || hostMatchesAny(r.Hosts, host)
+}
+
+// applyHeaderRules applies the header rules for target and host to header.
+func (p *Proxy) applyHeaderRules(target RuleTarget, host string, header http.Header) {
+	for _, rule := range p.matchingRules(target, RuleHeader, host) {
+		replaced := make(http.Header)
+		for name, values := range header {
+			for _, v := range values {
+				line := rule.re.ReplaceAllString(name+": "+v, rule.Replace)
+				if line == "" {
+					continue
+				}
+				i := strings.Index(line, ":")
+				if i <= 0 {
+					continue
+				}
+				name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+				replaced[name] = append(replaced[name], strings.TrimSpace(line[i+1:]))
+			}
+		}
+		for name := range header {
+			delete(header, name)
+		}
+		for name, values := range replaced {
+			header[name] = values
+		}
+	}
+}
+
+// applyRequestRules applies the URL and header rules to req.
+func (p *Proxy) applyRequestRules(req *http.Request) {
+	for _, rule := range p.matchingRules(RuleRequest, RuleURL, req.URL.Host) {
+		replaced := rule.re.ReplaceAllString(req.URL.String(), rule.Replace)
+		u, err := url.Parse(replaced)
+		if err != nil || u.Host == "" {
+			p.logger().Errorf("Invalid URL after a match and replace rule: %s", replaced)
+			continue
+		}
+		if u.Host != req.URL.Host {
+			req.Host = u.Host
+		}
+		req.URL = u
+	}
+	p.applyHeaderRules(RuleRequest, req.URL.Host, req.Header)
+}
+
+type websocketHostKey struct{}
+
+// websocketHost returns the host of the websocket carried by ctx.
+func websocketHost(ctx context.Context) string {
+	host, _ := ctx.Value(websocketHostKey{}).(string)
+	return host
+}
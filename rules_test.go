@@ -0,0 +1,144 @@
+package yves
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	testCases := []struct {
+		match    string
+		replace  string
+		hosts    []string
+		expected http.Header
+	}{
+		{`^User-Agent: .*$`, "User-Agent: yves", nil, http.Header{"User-Agent": {"yves"}, "Cookie": {"a=1"}}},
+		{`^Cookie: .*$`, "", nil, http.Header{"User-Agent": {"curl/7.79.1"}}},
+		{`curl/(\d+)\.\d+\.\d+`, "curl/$1", nil, http.Header{"User-Agent": {"curl/7"}, "Cookie": {"a=1"}}},
+		{`^Cookie: (.*)$`, "X-Cookie: $1", nil, http.Header{"User-Agent": {"curl/7.79.1"}, "X-Cookie": {"a=1"}}},
+		{`^Cookie: .*$`, "", []string{"*.example.org"}, http.Header{"User-Agent": {"curl/7.79.1"}, "Cookie": {"a=1"}}},
+		{`^Cookie: .*$`, "", []string{"*.example.com"}, http.Header{"User-Agent": {"curl/7.79.1"}}},
+	}
+	for _, tc := range testCases {
+		p := NewProxy()
+		if err := p.AddRule(MatchReplaceRule{Target: RuleRequest, Part: RuleHeader, Match: tc.match, Replace: tc.replace, Hosts: tc.hosts}); err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{"User-Agent": {"curl/7.79.1"}, "Cookie": {"a=1"}}
+		p.applyHeaderRules(RuleRequest, "www.example.com:443", header)
+		if len(header) != len(tc.expected) {
+			t.Errorf("Expected: %v, but got: %v", tc.expected, header)
+		}
+		for name := range tc.expected {
+			if header.Get(name) != tc.expected.Get(name) {
+				t.Errorf("Expected: %v, but got: %v", tc.expected, header)
+			}
+		}
+	}
+}
+
+func TestAddRuleErrors(t *testing.T) {
+	p := NewProxy()
+	for _, rule := range []MatchReplaceRule{
+		{Target: RuleRequest, Part: RuleBody, Match: "("},
+		{Target: RuleResponse, Part: RuleURL, Match: "foo"},
+	} {
+		if err := p.AddRule(rule); err == nil {
+			t.Errorf("Expected an error for %v", rule)
+		}
+	}
+}
+
+func TestMatchReplaceRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Server", "secret")
+		io.WriteString(w, r.URL.Path+" "+r.Header.Get("X-Token")+" "+string(body))
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	for _, rule := range []MatchReplaceRule{
+		{Target: RuleRequest, Part: RuleURL, Match: `/v1/(\w+)`, Replace: "/v2/$1"},
+		{Target: RuleRequest, Part: RuleHeader, Match: `^X-Token: .*$`, Replace: "X-Token: replaced"},
+		{Target: RuleRequest, Part: RuleBody, Match: `foo`, Replace: "bar"},
+		{Target: RuleResponse, Part: RuleHeader, Match: `^X-Server: .*$`},
+		{Target: RuleResponse, Part: RuleBody, Match: `(\w+) bar`, Replace: "${1} baz"},
+		{Target: RuleResponse, Part: RuleBody, Match: `v2`, Replace: "v3", Hosts: []string{"example.com"}},
+	} {
+		if err := p.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", upstream.URL+"/v1/users", bytes.NewBufferString("foo"))
+	req.Header.Set("X-Token", "original")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := "/v2/users replaced baz"; string(body) != expected {
+		t.Errorf("Expected: %s, but got: %s", expected, body)
+	}
+	if resp.Header.Get("X-Server") != "" {
+		t.Errorf("Expected the X-Server header to be removed, but got: %s", resp.Header.Get("X-Server"))
+	}
+
+	p.ClearRules()
+	resp, err = client.Get(upstream.URL + "/v1/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := "/v1/users  "; string(body) != expected {
+		t.Errorf("Expected: %s, but got: %s", expected, body)
+	}
+}
+
+func TestWebsocketRules(t *testing.T) {
+	p := NewProxy()
+	p.AddRule(MatchReplaceRule{Target: RuleRequest, Part: RuleBody, Match: "foo", Replace: "bar"})
+	p.AddRule(MatchReplaceRule{Target: RuleResponse, Part: RuleBody, Match: "hello", Replace: "bye"})
+
+	key := []byte{1, 2, 3, 4}
+	var src bytes.Buffer
+	for _, f := range []*WebsocketFragment{
+		{OpCode: TextMessage, MaskBit: true, Key: key, PayloadLength: 2, Data: []byte("fo")},
+		{OpCode: ContinuationFrame, FinBit: true, MaskBit: true, Key: key, PayloadLength: 5, Data: []byte("o foo")},
+		{OpCode: TextMessage, FinBit: true, MaskBit: true, Key: key, PayloadLength: 5, Data: []byte("hello")},
+	} {
+		f.Write(&src)
+	}
+	ctx := context.WithValue(context.Background(), websocketHostKey{}, "example.com:443")
+	var dst bytes.Buffer
+	if err := p.interceptWebsocket(ctx, ClientToServer, &dst, &src, nil, false, nil, nil); err != io.EOF {
+		t.Fatalf("Expected EOF, but got: %v", err)
+	}
+
+	r := bufio.NewReader(&dst)
+	var messages []string
+	var data []byte
+	for {
+		f, err := ReadWebsocketFragment(r)
+		if err != nil {
+			break
+		}
+		data = append(data, f.Data...)
+		if f.FinBit {
+			messages = append(messages, string(data))
+			data = nil
+		}
+	}
+	if len(messages) != 2 || messages[0] != "bar bar" || messages[1] != "hello" {
+		t.Errorf("Expected: [bar bar hello], but got: %v", messages)
+	}
+}
@@ -0,0 +1,107 @@
+package yves
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Scope selects the requests the handlers are executed for. A request is in
+// scope when it matches one of the Include patterns, if any, and none of the
+// Exclude ones.
+type Scope struct {
+	// IncludeHosts and ExcludeHosts contain glob patterns or CIDR ranges,
+	// see AllowHosts.
+	IncludeHosts []string
+	ExcludeHosts []string
+	// IncludePaths and ExcludePaths contain glob patterns, see path.Match.
+	// A pattern ending with /* also matches everything below, e.g. /api/*
+	// matches /api/v1/users. A pattern not starting with / matches the last
+	// element of the path, e.g. *.js.
+	IncludePaths []string
+	ExcludePaths []string
+}
+
+// Contains tells whether a request for host, which can contain a port, and
+// urlPath is in the scope.
+func (s *Scope) Contains(host, urlPath string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	for _, pattern := range s.ExcludeHosts {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	for _, pattern := range s.ExcludePaths {
+		if matchPath(pattern, urlPath) {
+			return false
+		}
+	}
+	return matchesAny(s.IncludeHosts, host, matchHost) && matchesAny(s.IncludePaths, urlPath, matchPath)
+}
+
+// matchesAny tells whether s matches one of patterns, true if there are no
+// patterns.
+func matchesAny(patterns []string, s string, match func(pattern, s string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath tells whether urlPath matches pattern, see Scope.
+func matchPath(pattern, urlPath string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		matched, err := path.Match(pattern, path.Base(urlPath))
+		return err == nil && matched
+	}
+	for p := urlPath; ; p = path.Dir(p) {
+		if matched, err := path.Match(pattern, p); err == nil && matched {
+			return true
+		}
+		if !strings.HasSuffix(pattern, "/*") || p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+type outOfScopeKey struct{}
+
+// scopeRequest returns the context for req and the copy of req given to
+// the response handlers, as it was received but with the absolute URL of
+// destinationHost. Requests out of Scope are not copied, their context
+// tells the handlers must not be executed.
+func (p *Proxy) scopeRequest(ctx context.Context, req *http.Request, destinationHost string) (context.Context, *http.Request) {
+	if p.outOfScope(req) {
+		return context.WithValue(ctx, outOfScopeKey{}, true), req
+	}
+	received := req.Clone(context.TODO())
+	// an invalid destination is reported when forwarding req
+	setDestination(received, destinationHost)
+	p.recordRequestBody(req, received)
+	return ctx, received
+}
+
+// outOfScope tells whether req is not in Scope.
+func (p *Proxy) outOfScope(req *http.Request) bool {
+	return p.Scope != nil && !p.Scope.Contains(req.Host, req.URL.Path)
+}
+
+// inScope tells whether the handlers must be executed for the request of
+// ctx.
+func inScope(ctx context.Context) bool {
+	outOfScope, _ := ctx.Value(outOfScopeKey{}).(bool)
+	return !outOfScope
+}
@@ -0,0 +1,85 @@
+package yves
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScopeContains(t *testing.T) {
+	testCases := []struct {
+		scope    Scope
+		host     string
+		path     string
+		expected bool
+	}{
+		{Scope{}, "example.com", "/", true},
+		{Scope{IncludeHosts: []string{"*.example.com"}}, "www.example.com:443", "/", true},
+		{Scope{IncludeHosts: []string{"*.example.com"}}, "example.org", "/", false},
+		{Scope{ExcludeHosts: []string{"*.google.com"}}, "www.google.com", "/", false},
+		{Scope{IncludePaths: []string{"/api/*"}}, "example.com", "/api/v1/users", true},
+		{Scope{IncludePaths: []string{"/api/*"}}, "example.com", "/static/app.js", false},
+		{Scope{IncludePaths: []string{"/api"}}, "example.com", "/api/v1", false},
+		{Scope{ExcludePaths: []string{"*.js", "/static/*"}}, "example.com", "/app.js", false},
+		{Scope{ExcludePaths: []string{"/static/*"}}, "example.com", "/static/img/logo.png", false},
+		{Scope{ExcludePaths: []string{"/static/*"}}, "example.com", "", true},
+		{Scope{IncludeHosts: []string{"example.com"}, ExcludePaths: []string{"/logout"}}, "example.com", "/logout", false},
+		{Scope{IncludeHosts: []string{"10.0.0.0/8"}}, "10.1.2.3:8080", "/", true},
+	}
+	for _, tc := range testCases {
+		if result := tc.scope.Contains(tc.host, tc.path); result != tc.expected {
+			t.Errorf("Expected: %v, but got: %v for %s%s in %+v", tc.expected, result, tc.host, tc.path, tc.scope)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Handled"))
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(upstream.Config.Handler)
+	defer tlsUpstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.Scope = &Scope{IncludePaths: []string{"/api/*"}}
+	var bodies int
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		req.Header.Set("X-Handled", "request")
+		return nil
+	}
+	p.HandleRequestBody = func(id int64, req *http.Request, body []byte) []byte {
+		bodies++
+		return nil
+	}
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		resp.Header.Set("X-Handled", "response")
+	}
+
+	for _, target := range []string{upstream.URL, tlsUpstream.URL} {
+		for _, tc := range []struct {
+			path    string
+			handled bool
+		}{
+			{"/api/users", true},
+			{"/static/app.js", false},
+		} {
+			bodies = 0
+			u, _ := url.Parse(target + tc.path)
+			resp, err := client.Get(u.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			handled := string(body) == "request" && resp.Header.Get("X-Handled") == "response" && bodies == 1
+			unhandled := string(body) == "" && resp.Header.Get("X-Handled") == "" && bodies == 0
+			if (tc.handled && !handled) || (!tc.handled && !unhandled) {
+				t.Errorf("Expected handled: %v for %s, but got: %q %q %d", tc.handled, u, body, resp.Header.Get("X-Handled"), bodies)
+			}
+		}
+	}
+}
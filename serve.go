@@ -0,0 +1,100 @@
+package yves
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Default timeouts of the server started by Serve. There is no read or write
+// timeout for the whole request, they would break long lived tunnels.
+const (
+	DefaultReadHeaderTimeout = 30 * time.Second
+	DefaultIdleTimeout       = 90 * time.Second
+)
+
+// Serve accepts connections on ln and serves them with the proxy. It
+// blocks until the proxy is shut down, in which case ErrProxyClosed is
+// returned.
+func (p *Proxy) Serve(ln net.Listener) error {
+	srv, err := p.newServer(ln)
+	if err != nil {
+		return err
+	}
+	return serve(srv, ln)
+}
+
+// newServer returns the server for ln, which is stopped by Shutdown.
+func (p *Proxy) newServer(ln net.Listener) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: p.ReadHeaderTimeout,
+		IdleTimeout:       p.IdleTimeout,
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = DefaultIdleTimeout
+	}
+
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	if p.shuttingDown {
+		ln.Close()
+		return nil, ErrProxyClosed
+	}
+	p.servers = append(p.servers, srv)
+	p.listeners = append(p.listeners, ln)
+	return srv, nil
+}
+
+func serve(srv *http.Server, ln net.Listener) error {
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return ErrProxyClosed
+	}
+	return err
+}
+
+// ListenAndServe listens on the TCP address addr and serves the
+// connections with the proxy, see Serve.
+func (p *Proxy) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(ln)
+}
+
+// Start listens on the TCP address addr and serves the connections in the
+// background. The address the proxy is listening on is returned, which is
+// useful when addr has port 0. Use Shutdown to stop the proxy.
+func (p *Proxy) Start(addr string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := p.newServer(ln)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := serve(srv, ln); err != ErrProxyClosed {
+			p.logger().Errorf("Serve error: %v", err)
+		}
+	}()
+	return ln.Addr(), nil
+}
+
+// Addr returns the address of the first listener passed to Serve or
+// ServeTransparent, nil if
+// the proxy is not serving any.
+func (p *Proxy) Addr() net.Addr {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	if len(p.listeners) == 0 {
+		return nil
+	}
+	return p.listeners[0].Addr()
+}
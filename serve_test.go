@@ -0,0 +1,50 @@
+package yves
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	addr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr().String() != addr.String() {
+		t.Errorf("Expected: %s, but got: %s", addr, p.Addr())
+	}
+
+	proxyUrl, _ := url.Parse("http://" + addr.String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("Expected: hello, but got: %s", body)
+	}
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Errorf("Expected the listener to be closed")
+	}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	if err := p.Serve(ln); err != ErrProxyClosed {
+		t.Errorf("Expected: %v, but got: %v", ErrProxyClosed, err)
+	}
+}
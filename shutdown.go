@@ -0,0 +1,127 @@
+package yves
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrProxyClosed is returned by Shutdown when the proxy has already been shut down.
+var ErrProxyClosed = errors.New("proxy closed")
+
+// Shutdown stops the proxy from serving new connections, closing the
+// listeners passed to Serve and ServeTransparent, signals websockets
+// to close and waits for the connections being served to complete. If ctx
+// expires before that, the remaining connections are closed and the
+// context error is returned. The idle connections with the remote hosts
+// are closed last.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.connsMutex.Lock()
+	if p.shuttingDown {
+		p.connsMutex.Unlock()
+		return ErrProxyClosed
+	}
+	p.shuttingDown = true
+	close(p.doneChan())
+	servers := p.servers
+	listeners := p.listeners
+	p.connsMutex.Unlock()
+
+	// stop accepting new connections, the hijacked ones are not
+	// tracked by the servers and are waited for below.
+	for _, srv := range servers {
+		srv.Close()
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	// no more certificates are needed
+	p.stopKeyPools()
+
+	finished := make(chan struct{})
+	go func() {
+		p.connsWG.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		p.closeIdleUpstream()
+		return nil
+	case <-ctx.Done():
+		p.connsMutex.Lock()
+		for c := range p.activeConns {
+			c.Close()
+		}
+		p.connsMutex.Unlock()
+		<-finished
+		p.closeIdleUpstream()
+		return ctx.Err()
+	}
+}
+
+// closeIdleUpstream closes the kept-alive connections with the remote
+// hosts, and the ones established while handling a CONNECT that the
+// transport has not used.
+func (p *Proxy) closeIdleUpstream() {
+	if p.Tr != nil {
+		p.Tr.CloseIdleConnections()
+	}
+	if p.HttpClient != nil {
+		p.HttpClient.CloseIdleConnections()
+	}
+	p.upstreamConnsMutex.Lock()
+	defer p.upstreamConnsMutex.Unlock()
+	for _, conns := range p.upstreamConns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	p.upstreamConns = nil
+}
+
+// doneChan returns the channel closed on Shutdown. connsMutex must be held.
+func (p *Proxy) doneChan() chan struct{} {
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	return p.done
+}
+
+// shutdownSignal returns a channel that is closed when the proxy is shut down.
+func (p *Proxy) shutdownSignal() <-chan struct{} {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	return p.doneChan()
+}
+
+// isShuttingDown tells whether Shutdown has been called.
+func (p *Proxy) isShuttingDown() bool {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	return p.shuttingDown
+}
+
+// addConn tracks a hijacked connection. It returns false if the proxy is
+// shutting down and the connection should not be served.
+func (p *Proxy) addConn(c net.Conn) bool {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	if p.shuttingDown {
+		return false
+	}
+	if p.activeConns == nil {
+		p.activeConns = make(map[net.Conn]struct{})
+	}
+	p.activeConns[c] = struct{}{}
+	p.connsWG.Add(1)
+	return true
+}
+
+// removeConn stops tracking a connection once it has been served.
+func (p *Proxy) removeConn(c net.Conn) {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+	delete(p.activeConns, c)
+	p.connsWG.Done()
+}
@@ -0,0 +1,115 @@
+package yves
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	// a server that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := NewProxy()
+	p.HandleConnect = func(id int64, host string) ConnectAction {
+		return ConnectAction{Action: ConnectTunnel}
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := ln.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	reader := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(reader, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tunnel is still open when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected: %v, but got: %v", context.DeadlineExceeded, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err == nil || os.IsTimeout(err) {
+		t.Errorf("Expected the tunnel to be closed, but got: %v", err)
+	}
+
+	// new requests are refused
+	resp, err := http.Get(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected: 503, but got: %d", resp.StatusCode)
+	}
+	if err := p.Shutdown(context.Background()); err != ErrProxyClosed {
+		t.Errorf("Expected: %v, but got: %v", ErrProxyClosed, err)
+	}
+}
+
+func TestShutdownClosesIdleUpstream(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// a connection established for a CONNECT, not used by the transport
+	pooled, other := net.Pipe()
+	defer other.Close()
+	p.putUpstreamConn("example.com:443", pooled)
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the kept-alive connection with the upstream to be closed")
+	}
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected: %v, but got: %v", io.EOF, err)
+	}
+}
@@ -0,0 +1,64 @@
+package yves
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// CertSigner signs the leaf certificates generated by the proxy.
+// Implement it to keep the CA private key in an HSM or in a remote signing
+// service instead of providing it as PEM in CaKey.
+type CertSigner interface {
+	// Certificate returns the CA certificate.
+	Certificate() *x509.Certificate
+
+	// SignCertificate signs template for the public key pub and returns
+	// the certificate in DER format.
+	SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error)
+}
+
+// NewCertSigner returns a CertSigner that signs with the CA certificate
+// cert and its private key. Any crypto.Signer can be used as key, such as
+// the ones provided by PKCS#11 libraries.
+func NewCertSigner(cert *x509.Certificate, key crypto.Signer) CertSigner {
+	return &keySigner{cert: cert, key: key}
+}
+
+// keySigner is the default CertSigner.
+type keySigner struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func (s *keySigner) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+func (s *keySigner) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	return x509.CreateCertificate(rand.Reader, template, s.cert, pub, s.key)
+}
+
+// tlsCertSigner returns a CertSigner for a parsed CA key pair.
+func tlsCertSigner(ca tls.Certificate) (CertSigner, error) {
+	key, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA private key cannot sign")
+	}
+	return NewCertSigner(ca.Leaf, key), nil
+}
+
+// signer returns the CertSigner of the proxy, which is Signer if set or
+// the CaCert/CaKey pair otherwise.
+func (p *Proxy) signer() (CertSigner, error) {
+	if p.Signer != nil {
+		return p.Signer, nil
+	}
+	CA, err := p.loadCA()
+	if err != nil {
+		return nil, err
+	}
+	return tlsCertSigner(CA)
+}
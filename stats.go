@@ -0,0 +1,156 @@
+package yves
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of the proxy.
+type Stats struct {
+	// Requests is the number of requests forwarded or answered by HandleRequest.
+	Requests int64
+	// Responses is the number of responses sent to the clients by status
+	// class, e.g. "2xx".
+	Responses map[string]int64
+	// Errors is the number of requests that failed.
+	Errors int64
+	// BytesReceived and BytesSent count the bytes read from and written to
+	// the clients, including tunnels and websockets.
+	BytesReceived int64
+	BytesSent     int64
+	// TLSHandshakeFailures is the number of failed TLS handshakes with the clients.
+	TLSHandshakeFailures int64
+	// WebsocketFrames is the number of websocket frames proxied.
+	WebsocketFrames int64
+	// ActiveConnections is the number of client connections being served.
+	ActiveConnections int64
+	// ActiveRequests is the number of requests being forwarded, until the
+	// body of their response has been sent.
+	ActiveRequests int64
+}
+
+// counters are updated atomically, they are kept in their own struct so
+// that they are 64-bit aligned.
+type counters struct {
+	requests             int64
+	responses            [5]int64
+	errors               int64
+	bytesReceived        int64
+	bytesSent            int64
+	tlsHandshakeFailures int64
+	websocketFrames      int64
+	activeConnections    int64
+	activeRequests       int64
+}
+
+func (c *counters) addResponse(statusCode int) {
+	class := statusCode/100 - 1
+	if class < 0 || class >= len(c.responses) {
+		return
+	}
+	atomic.AddInt64(&c.responses[class], 1)
+}
+
+// Stats returns a snapshot of the counters of the proxy.
+func (p *Proxy) Stats() Stats {
+	c := &p.counters
+	s := Stats{
+		Requests:             atomic.LoadInt64(&c.requests),
+		Responses:            make(map[string]int64),
+		Errors:               atomic.LoadInt64(&c.errors),
+		BytesReceived:        atomic.LoadInt64(&c.bytesReceived),
+		BytesSent:            atomic.LoadInt64(&c.bytesSent),
+		TLSHandshakeFailures: atomic.LoadInt64(&c.tlsHandshakeFailures),
+		WebsocketFrames:      atomic.LoadInt64(&c.websocketFrames),
+		ActiveConnections:    atomic.LoadInt64(&c.activeConnections),
+		ActiveRequests:       atomic.LoadInt64(&c.activeRequests),
+	}
+	for i := range c.responses {
+		s.Responses[fmt.Sprintf("%dxx", i+1)] = atomic.LoadInt64(&c.responses[i])
+	}
+	return s
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition
+// format, so that they can be scraped without depending on the Prometheus
+// client library.
+func (s Stats) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"yves_requests_total", "counter", "Requests received.", s.Requests},
+		{"yves_errors_total", "counter", "Requests that failed.", s.Errors},
+		{"yves_received_bytes_total", "counter", "Bytes read from the clients.", s.BytesReceived},
+		{"yves_sent_bytes_total", "counter", "Bytes written to the clients.", s.BytesSent},
+		{"yves_tls_handshake_failures_total", "counter", "Failed TLS handshakes with the clients.", s.TLSHandshakeFailures},
+		{"yves_websocket_frames_total", "counter", "Websocket frames proxied.", s.WebsocketFrames},
+		{"yves_active_connections", "gauge", "Client connections being served.", s.ActiveConnections},
+		{"yves_active_requests", "gauge", "Requests being forwarded.", s.ActiveRequests},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "# HELP yves_responses_total Responses sent to the clients.\n# TYPE yves_responses_total counter\n"); err != nil {
+		return err
+	}
+	classes := make([]string, 0, len(s.Responses))
+	for class := range s.Responses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		if _, err := fmt.Fprintf(w, "yves_responses_total{class=%q} %d\n", class, s.Responses[class]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrTooManyRequests is returned when MaxConcurrentRequests requests are
+// already being forwarded, the client gets a 503.
+var ErrTooManyRequests = errors.New("too many requests in progress")
+
+// acquire increments counter unless it has reached max, zero meaning no
+// limit, and tells whether it did.
+func acquire(counter *int64, max int) bool {
+	for {
+		n := atomic.LoadInt64(counter)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, n, n+1) {
+			return true
+		}
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,150 @@
+package yves
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	s := p.Stats()
+	if s.Requests != 1 || s.Responses["4xx"] != 1 || s.Responses["2xx"] != 0 {
+		t.Errorf("Unexpected request counters: %+v", s)
+	}
+	if s.BytesSent == 0 {
+		t.Errorf("Expected the bytes sent to the client to be counted")
+	}
+
+	var buf bytes.Buffer
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"yves_requests_total 1\n", "yves_responses_total{class=\"4xx\"} 1\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestMaxConcurrentConnections(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	echoServer(ln, "")
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.MaxConcurrentConnections = 2
+	// two tunnels kept open
+	for i := 0; i < 2; i++ {
+		conn, _ := connectTunnel(t, p.Addr().String(), ln.Addr().String())
+		defer conn.Close()
+	}
+	if n := p.Stats().ActiveConnections; n != 2 {
+		t.Errorf("Expected: 2, but got: %d", n)
+	}
+
+	// the next connection is refused right away
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.URL, upstream.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected: %d, but got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if n := p.Stats().ActiveConnections; n != 2 {
+		t.Errorf("Expected: 2, but got: %d", n)
+	}
+
+	p.MaxConcurrentConnections = 3
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected: %d, but got: %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer upstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.MaxConcurrentRequests = 1
+	done := make(chan error)
+	go func() {
+		resp, err := client.Get(upstream.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	for i := 0; p.Stats().ActiveRequests != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the slow request to be in progress")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected: %d, but got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// the response body is closed once it has been sent
+	for i := 0; p.Stats().ActiveRequests != 0; i++ {
+		if i == 100 {
+			t.Fatalf("Expected: 0, but got: %d", p.Stats().ActiveRequests)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
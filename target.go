@@ -0,0 +1,73 @@
+package yves
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The forms of the request target, see RFC 7230 section 5.3.
+//
+//	origin-form     GET /path HTTP/1.1, sent to the servers
+//	absolute-form   GET http://host/path HTTP/1.1, sent to the proxies
+//	authority-form  CONNECT host:port HTTP/1.1
+//	asterisk-form   OPTIONS * HTTP/1.1
+
+// plainTarget returns the destination of a request received in plain HTTP,
+// the scheme and the host of its absolute-form target. Clients wrongly
+// sending the origin-form are sent to the host in the Host header, unless
+// it is the proxy itself. The other forms are refused.
+func plainTarget(req *http.Request) (string, error) {
+	switch {
+	case req.URL.IsAbs():
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return "", fmt.Errorf("unsupported scheme in request target %q", req.RequestURI)
+		}
+		if req.URL.Host == "" || req.URL.User != nil {
+			return "", fmt.Errorf("invalid request target %q", req.RequestURI)
+		}
+		return req.URL.Scheme + "://" + req.URL.Host, nil
+	case strings.HasPrefix(req.RequestURI, "/"):
+		if req.Host == "" {
+			return "", fmt.Errorf("request target %q without Host header", req.RequestURI)
+		}
+		if isLocalAddr(req, req.Host) {
+			return "", fmt.Errorf("request target %q is not for a proxy", req.RequestURI)
+		}
+		return "http://" + req.Host, nil
+	}
+	return "", fmt.Errorf("invalid request target %q", req.RequestURI)
+}
+
+// connectTarget returns host:port, the authority-form target of a CONNECT.
+// Clients omitting the port get 443.
+func connectTarget(req *http.Request) (string, error) {
+	// the URL of a CONNECT has no scheme, only a host
+	if req.URL.Host == "" || req.URL.Path != "" || req.URL.User != nil || req.URL.RawQuery != "" {
+		return "", fmt.Errorf("invalid CONNECT target %q", req.RequestURI)
+	}
+	return hostPort(req.URL.Host, "443"), nil
+}
+
+// isLocalAddr tells whether host is the address the client connected to,
+// i.e. the proxy, which must not forward the request to itself.
+func isLocalAddr(req *http.Request, host string) bool {
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	h, port, err := net.SplitHostPort(hostPort(host, "80"))
+	if err != nil || port != localPort {
+		return false
+	}
+	if strings.EqualFold(h, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified() || ip.Equal(net.ParseIP(localHost)))
+}
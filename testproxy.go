@@ -0,0 +1,44 @@
+package yves
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// NewTestProxy starts a proxy on an ephemeral port of the loopback
+// interface, to be used in tests. The returned client sends its requests
+// through the proxy and trusts the CA of the proxy, so HTTPS requests are
+// intercepted as well. The handlers can be set on the proxy once it is
+// running. cleanup shuts the proxy down.
+func NewTestProxy(t testing.TB) (p *Proxy, client *http.Client, cleanup func()) {
+	t.Helper()
+	p = NewProxy()
+	addr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start the proxy: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(p.CaCert) {
+		t.Fatalf("Cannot parse the CA certificate of the proxy")
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: addr.String()}
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	client = &http.Client{Transport: tr}
+
+	cleanup = func() {
+		tr.CloseIdleConnections()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	}
+	return p, client, cleanup
+}
@@ -0,0 +1,67 @@
+package yves
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewTestProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.Header.Get("X-Added")+" "+string(body))
+	})
+	upstream := httptest.NewServer(handler)
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(handler)
+	defer tlsUpstream.Close()
+
+	p, client, cleanup := NewTestProxy(t)
+	defer cleanup()
+	p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+		if req.URL.Path == "/mocked" {
+			return NewResponse(http.StatusTeapot, nil, []byte("mocked"))
+		}
+		req.Header.Set("X-Added", "added")
+		return nil
+	}
+	p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+		resp.Header.Set("X-Proxy", "yves")
+	}
+	p.HandleResponseBody = func(id int64, resp *http.Response, body []byte) []byte {
+		return bytes.ToUpper(body)
+	}
+
+	testCases := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"GET", "/", "", http.StatusOK, "GET ADDED "},
+		{"POST", "/", "payload", http.StatusOK, "POST ADDED PAYLOAD"},
+		{"GET", "/mocked", "", http.StatusTeapot, "MOCKED"},
+	}
+	for _, server := range []*httptest.Server{upstream, tlsUpstream} {
+		for _, tc := range testCases {
+			req, _ := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status || string(body) != tc.expected {
+				t.Errorf("Expected: %d %s, but got: %d %s", tc.status, tc.expected, resp.StatusCode, body)
+			}
+			if resp.Header.Get("X-Proxy") != "yves" {
+				t.Errorf("Expected the response to be modified by HandleResponse")
+			}
+		}
+	}
+}
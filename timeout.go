@@ -0,0 +1,51 @@
+package yves
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultRequestTimeout is the default value of Proxy.RequestTimeout.
+const DefaultRequestTimeout = 10 * time.Second
+
+type timeoutKey struct{}
+
+// SetTimeout overrides RequestTimeout for req, it is meant to be called from
+// HandleRequest. A timeout of zero or less disables the timeout, e.g. for
+// Server-Sent Events or long downloads.
+func SetTimeout(req *http.Request, timeout time.Duration) {
+	*req = *req.WithContext(context.WithValue(req.Context(), timeoutKey{}, timeout))
+}
+
+// requestContext returns the context used to forward req, bounded by the
+// timeout of the request. A deadline already set on the context of req is
+// kept as is.
+func (p *Proxy) requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	timeout := p.RequestTimeout
+	if t, ok := ctx.Value(timeoutKey{}).(time.Duration); ok {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// cancelBody cancels the context of a request once its response body
+// has been closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,50 @@
+package yves
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		set     bool
+		wantErr bool
+	}{
+		{"global timeout", 0, false, true},
+		{"longer timeout", time.Second, true, false},
+		{"no timeout", 0, true, false},
+	}
+	for _, tt := range tests {
+		p := NewProxy()
+		p.RequestTimeout = 50 * time.Millisecond
+		p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+			if tt.set {
+				SetTimeout(req, tt.timeout)
+			}
+			return nil
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := p.forwardReq(p.newSession(), req, upstream.URL)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Expected error: %v, but got: %v", tt.name, tt.wantErr, err)
+		}
+		if err == nil {
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != "hello" {
+				t.Errorf("%s: Expected: hello, but got: %q %v", tt.name, body, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package yves
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Timing tells when a request went through the proxy.
+type Timing struct {
+	// Start is when the proxy started handling the request.
+	Start time.Time
+	// Sent is when the request was sent to the remote host, zero if the
+	// response was returned by HandleRequest.
+	Sent time.Time
+	// Response is when the headers of the response were received.
+	Response time.Time
+}
+
+// Duration is the time taken to get the response.
+func (t Timing) Duration() time.Duration {
+	return t.Response.Sub(t.Start)
+}
+
+type timingKey struct{}
+
+// ResponseTiming returns the timing of the request resp is the response
+// to, it is meant to be called from HandleResponse.
+func ResponseTiming(resp *http.Response) (Timing, bool) {
+	if resp == nil || resp.Request == nil {
+		return Timing{}, false
+	}
+	t, ok := resp.Request.Context().Value(timingKey{}).(*Timing)
+	if !ok {
+		return Timing{}, false
+	}
+	return *t, true
+}
+
+// withTiming returns req with a new Timing in its context.
+func withTiming(req *http.Request) (*http.Request, *Timing) {
+	t := &Timing{Start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), timingKey{}, t)), t
+}
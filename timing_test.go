@@ -0,0 +1,59 @@
+package yves
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseTiming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	var tests = []struct {
+		name      string
+		shortcut  bool
+		minimum   time.Duration
+		forwarded bool
+	}{
+		{"Forwarded", false, 20 * time.Millisecond, true},
+		{"Fabricated", true, 0, false},
+	}
+	for _, tc := range tests {
+		p := NewProxy()
+		p.HandleRequest = func(id int64, req *http.Request) *http.Response {
+			if tc.shortcut {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+			}
+			return nil
+		}
+		var timing Timing
+		var ok bool
+		p.HandleResponse = func(id int64, req *http.Request, resp *http.Response) {
+			timing, ok = ResponseTiming(resp)
+		}
+		ctx := p.newSession()
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := p.forwardReq(ctx, req, upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.handleResp(ctx, resp, req); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if !ok {
+			t.Fatalf("%s: Expected the timing to be available", tc.name)
+		}
+		if timing.Duration() < tc.minimum {
+			t.Errorf("%s: Expected at least %v, but got: %v", tc.name, tc.minimum, timing.Duration())
+		}
+		if timing.Sent.IsZero() == tc.forwarded {
+			t.Errorf("%s: Unexpected sent time: %v", tc.name, timing.Sent)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package yves
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -11,11 +13,11 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"time"
-)
 
-// certs is used to mantain a map of certificates that have already been created.
-var certs map[string]*tls.Certificate
+	"golang.org/x/net/publicsuffix"
+)
 
 // Some constants for creating certificates.
 const (
@@ -31,28 +33,236 @@ const (
 	leafUsage = caUsage
 )
 
+// loadCA parses the CA key pair of the proxy.
+func (p *Proxy) loadCA() (tls.Certificate, error) {
+	// get CA key pair
+	CA, err := tls.X509KeyPair(p.CaCert, p.CaKey)
+	if err != nil {
+		return CA, fmt.Errorf("Cannot parse provided CA key pair %s", err)
+	}
+	// get CA certificate
+	CA.Leaf, err = x509.ParseCertificate(CA.Certificate[0])
+	if err != nil {
+		return CA, fmt.Errorf("Cannot parse CA certificate: %s", err)
+	}
+	return CA, nil
+}
+
 // getCert obtains a certificate for a given hostname. If a certificate
-// has already been created for that hostname, it is retrieved and returned.
-func getCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
-	if val, ok := certs[host]; ok {
+// has already been created for that hostname, it is retrieved and returned,
+// unless it is about to expire.
+// The cache is per Proxy instance so that different proxies never share certificates.
+// upstream is the certificate presented by the real server, if known.
+func (p *Proxy) getCert(signer CertSigner, host string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	host = p.certName(host)
+	p.certMutex.RLock()
+	val, ok := p.certCache[host]
+	p.certMutex.RUnlock()
+	if ok && certFresh(val, time.Now()) {
 		return val, nil
 	}
-	cert, err := GenerateCert(ca, host)
-	if err != nil {
-		return nil, err
+
+	p.certMutex.Lock()
+	// another goroutine may have created the certificate while
+	// I was waiting for the lock.
+	if val, ok := p.certCache[host]; ok && certFresh(val, time.Now()) {
+		p.certMutex.Unlock()
+		return val, nil
 	}
-	// save host and cert so that the next time I won't regenerate the certificate.
-	certs[host] = cert
-	return cert, nil
+	// or it may be creating it, wait for it rather than signing twice
+	if call, ok := p.certCalls[host]; ok {
+		p.certMutex.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	if p.certCalls == nil {
+		p.certCalls = make(map[string]*certCall)
+	}
+	p.certCalls[host] = call
+	opts := p.leafOptions(upstream)
+	if p.LeafKeyPoolSize > 0 {
+		opts.keys = p.leafKeyPool(leafKeyType(opts.keyType, signer.Certificate().PublicKey))
+	}
+	p.certMutex.Unlock()
+
+	// the key generation and the signature do not hold back the
+	// handshakes for the other hosts
+	call.cert, call.err = generateCert(signer, host, opts)
+
+	p.certMutex.Lock()
+	delete(p.certCalls, host)
+	if call.err == nil {
+		if p.certCache == nil {
+			p.certCache = make(map[string]*tls.Certificate)
+		}
+		// save host and cert so that the next time I won't regenerate the certificate.
+		p.certCache[host] = call.cert
+	}
+	p.certMutex.Unlock()
+	close(call.done)
+	if call.err != nil {
+		return nil, call.err
+	}
+	if p.CertCacheDir != "" {
+		if err := saveCert(p.CertCacheDir, host, call.cert); err != nil {
+			p.logger().Errorf("Cannot save certificate for %s: %v", host, err)
+		}
+	}
+	return call.cert, nil
+}
+
+// certRenewMargin is how long before it expires a cached certificate is
+// generated again, so that the clients never get an expired one.
+const certRenewMargin = time.Minute
+
+// certFresh tells whether the cached cert can still be served at now.
+func certFresh(cert *tls.Certificate, now time.Time) bool {
+	return cert.Leaf == nil || now.Before(cert.Leaf.NotAfter.Add(-certRenewMargin))
+}
+
+// certCall is a certificate being generated, done is closed once cert or
+// err is set.
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// KeyType is the type of the keys of the generated certificates.
+type KeyType int
+
+const (
+	// KeyAuto uses the same type of key as the CA.
+	KeyAuto KeyType = iota
+	KeyRSA2048
+	KeyECDSAP256
+	KeyECDSAP384
+)
+
+// leafKeyType returns keyType, or the type matching caKey for KeyAuto.
+func leafKeyType(keyType KeyType, caKey crypto.PublicKey) KeyType {
+	if keyType != KeyAuto {
+		return keyType
+	}
+	switch k := caKey.(type) {
+	case *rsa.PublicKey:
+		return KeyRSA2048
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return KeyECDSAP256
+		}
+	}
+	return KeyECDSAP384
+}
+
+// generateKey generates a key of type keyType, or of the same type as
+// caKey for KeyAuto.
+func generateKey(keyType KeyType, caKey crypto.PublicKey) (crypto.Signer, error) {
+	switch leafKeyType(keyType, caKey) {
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %d", keyType)
+}
+
+// certName returns the name of the certificate for host, which is also the
+// key of the cache: host in lower case, without the trailing dot nor the
+// brackets of an IPv6 literal, or the wildcard name covering host if
+// UseWildcardCerts is set.
+func (p *Proxy) certName(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if p.UseWildcardCerts && net.ParseIP(host) == nil {
+		if wildcard := wildcardName(host); wildcard != "" {
+			return wildcard
+		}
+	}
+	return host
+}
+
+// leafOptions controls how leaf certificates are generated.
+type leafOptions struct {
+	// maxAge is the validity of the certificate, leafMaxAge if zero.
+	maxAge time.Duration
+	// upstream is the certificate of the real server, if set its SANs are copied.
+	upstream *x509.Certificate
+	// mirror copies the validity of upstream too.
+	mirror  bool
+	keyType KeyType
+	// keys, if set, provides the key instead of keyType.
+	keys *keyPool
+}
+
+func (p *Proxy) leafOptions(upstream *x509.Certificate) leafOptions {
+	opts := leafOptions{maxAge: p.LeafMaxAge, keyType: p.LeafKeyType}
+	if p.CopyUpstreamSANs || p.MirrorUpstream {
+		opts.upstream = upstream
+	}
+	if p.MirrorUpstream && upstream != nil {
+		opts.mirror = true
+		if keyType, ok := certKeyType(upstream.PublicKey); ok {
+			opts.keyType = keyType
+		}
+	}
+	return opts
+}
+
+// certKeyType returns the type of key, if it is one of the KeyType.
+func certKeyType(key crypto.PublicKey) (KeyType, bool) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return KeyRSA2048, true
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256, true
+		case elliptic.P384():
+			return KeyECDSAP384, true
+		}
+	}
+	return KeyAuto, false
+}
+
+// mirrorVersion makes conf accept up to version, the TLS version negotiated
+// with the real server, unless conf does not accept version at all.
+func mirrorVersion(conf *tls.Config, version uint16) {
+	minVersion := conf.MinVersion
+	if minVersion == 0 {
+		// the oldest versions only if they are asked for
+		minVersion = tls.VersionTLS12
+	}
+	if version < minVersion || (conf.MaxVersion != 0 && version > conf.MaxVersion) {
+		return
+	}
+	conf.MaxVersion = version
 }
 
 // GenerateCert generates a new tls.Certificate certificate to present to the client.
 func GenerateCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
+	signer, err := tlsCertSigner(ca)
+	if err != nil {
+		return nil, err
+	}
+	return generateCert(signer, host, leafOptions{})
+}
+
+// generateCert generates a certificate for host and has it signed by signer.
+func generateCert(signer CertSigner, host string, opts leafOptions) (*tls.Certificate, error) {
+	// an IPv6 literal may come bracketed, e.g. from a Host header
+	host = strings.Trim(host, "[]")
 	// basic example from https://golang.org/src/crypto/tls/generate_cert.go
 	now := time.Now().Add(-1 * time.Hour).UTC()
-	if !ca.Leaf.IsCA {
+	if !signer.Certificate().IsCA {
 		return nil, errors.New("CA Certificate is not really a CA.")
 	}
+	maxAge := opts.maxAge
+	if maxAge == 0 {
+		maxAge = leafMaxAge
+	}
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
@@ -62,8 +272,9 @@ func GenerateCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
 		SerialNumber:          serialNumber,
 		Subject:               pkix.Name{CommonName: host},
 		NotBefore:             now,
-		NotAfter:              now.Add(leafMaxAge),
+		NotAfter:              now.Add(maxAge),
 		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
 
@@ -71,14 +282,32 @@ func GenerateCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
 		template.IPAddresses = append(template.IPAddresses, ip)
 	} else {
 		template.DNSNames = append(template.DNSNames, host)
+		if wildcard := wildcardName(host); wildcard != "" {
+			template.DNSNames = append(template.DNSNames, wildcard)
+		}
+	}
+	if opts.upstream != nil {
+		addSANs(template, opts.upstream)
+	}
+	if opts.mirror {
+		mirrorValidity(template, opts.upstream, signer.Certificate())
 	}
 
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	var key crypto.Signer
+	if opts.keys != nil {
+		key, err = opts.keys.get()
+	} else {
+		key, err = generateKey(opts.keyType, signer.Certificate().PublicKey)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		// needed by the clients using the RSA key exchange
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
+	derBytes, err := signer.SignCertificate(template, key.Public())
 	if err != nil {
 		return nil, err
 	}
@@ -91,3 +320,61 @@ func GenerateCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
 
 	return cert, nil
 }
+
+// wildcardName returns the wildcard name covering host and its siblings,
+// e.g. *.example.com for www.example.com. An empty string is returned when
+// host is a registrable domain, as the wildcard would cover a public
+// suffix, e.g. *.co.uk for bbc.co.uk, which the browsers reject.
+func wildcardName(host string) string {
+	labels := strings.Split(host, ".")
+	if labels[0] == "*" {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil || domain == host {
+		return ""
+	}
+	return "*." + strings.Join(labels[1:], ".")
+}
+
+// mirrorValidity gives template the validity of upstream, within the one
+// of ca so that the clients do not reject it.
+func mirrorValidity(template, upstream, ca *x509.Certificate) {
+	template.NotBefore = upstream.NotBefore
+	template.NotAfter = upstream.NotAfter
+	if template.NotBefore.Before(ca.NotBefore) {
+		template.NotBefore = ca.NotBefore
+	}
+	if template.NotAfter.After(ca.NotAfter) {
+		template.NotAfter = ca.NotAfter
+	}
+}
+
+// addSANs copies the subject alternative names of upstream in template.
+func addSANs(template *x509.Certificate, upstream *x509.Certificate) {
+	for _, name := range upstream.DNSNames {
+		if !containsString(template.DNSNames, name) {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	for _, ip := range upstream.IPAddresses {
+		found := false
+		for _, other := range template.IPAddresses {
+			if other.Equal(ip) {
+				found = true
+			}
+		}
+		if !found {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
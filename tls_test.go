@@ -0,0 +1,463 @@
+package yves
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testCA(t testing.TB) tls.Certificate {
+	ca, err := tls.X509KeyPair(caCert, caKey)
+	if err != nil {
+		t.Fatalf("Cannot parse CA key pair: %v", err)
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatalf("Cannot parse CA certificate: %v", err)
+	}
+	return ca
+}
+
+func testSigner(t testing.TB) CertSigner {
+	signer, err := tlsCertSigner(testCA(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestGetCertConcurrent(t *testing.T) {
+	signer := testSigner(t)
+	p := NewProxy()
+
+	var wg sync.WaitGroup
+	results := make([]*tls.Certificate, 40)
+	for i := 0; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every host is requested by four goroutines
+			host := fmt.Sprintf("host%d.example.com", i%10)
+			cert, err := p.getCert(signer, host, nil)
+			if err != nil {
+				t.Errorf("getCert(%s): %v", host, err)
+				return
+			}
+			results[i] = cert
+		}(i)
+	}
+	wg.Wait()
+
+	for i, cert := range results {
+		if cert == nil {
+			continue
+		}
+		if cert != results[i%10] {
+			t.Errorf("host%d.example.com: certificate was generated more than once", i%10)
+		}
+	}
+	if len(p.certCache) != 10 {
+		t.Errorf("Expected 10 cached certificates, but got %d", len(p.certCache))
+	}
+}
+
+// blockingSigner signs the certificates of slow.example.com once release
+// is closed.
+type blockingSigner struct {
+	CertSigner
+	release chan struct{}
+}
+
+func (s blockingSigner) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	for _, name := range template.DNSNames {
+		if name == "slow.example.com" {
+			<-s.release
+		}
+	}
+	return s.CertSigner.SignCertificate(template, pub)
+}
+
+func TestGetCertDoesNotBlockOtherHosts(t *testing.T) {
+	signer := blockingSigner{testSigner(t), make(chan struct{})}
+	p := NewProxy()
+
+	slow := make(chan *tls.Certificate, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			cert, _ := p.getCert(signer, "slow.example.com", nil)
+			slow <- cert
+		}()
+	}
+	// wait for the slow certificate to be in progress
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		p.certMutex.RLock()
+		_, inProgress := p.certCalls["slow.example.com"]
+		p.certMutex.RUnlock()
+		if inProgress {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The slow certificate is not being generated")
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.getCert(signer, "fast.example.com", nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The certificate of another host waited for the slow one")
+	}
+
+	close(signer.release)
+	a, b := <-slow, <-slow
+	if a == nil || a != b {
+		t.Errorf("Expected a single certificate for slow.example.com, but got: %p %p", a, b)
+	}
+}
+
+func TestCertCachePerProxy(t *testing.T) {
+	signer := testSigner(t)
+	p1 := NewProxy()
+	p2 := NewProxy()
+
+	c1, err := p1.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p2.certCache["example.com"]; ok {
+		t.Errorf("Certificate leaked to a different proxy")
+	}
+	c2, err := p2.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 == c2 {
+		t.Errorf("Expected different proxies to generate their own certificates")
+	}
+}
+
+func TestGetCertExpired(t *testing.T) {
+	signer := testSigner(t)
+	p := NewProxy()
+	// the certificates are backdated by an hour, this one expires right
+	// after the renew margin
+	p.LeafMaxAge = time.Hour + certRenewMargin + 2*time.Second
+	c1, err := p.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Errorf("Expected the certificate to be cached")
+	}
+	time.Sleep(3 * time.Second)
+	c3, err := p.getCert(signer, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c1 || !certFresh(c3, time.Now()) {
+		t.Errorf("Expected a new certificate, but got the expiring one")
+	}
+}
+
+func TestGenerateCertVerifies(t *testing.T) {
+	ca := testCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	cert, err := GenerateCert(ca, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"www.example.com", "api.example.com"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:   name,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			t.Errorf("Certificate does not verify for %s: %v", name, err)
+		}
+	}
+}
+
+func TestGenerateCertCopiesUpstreamSANs(t *testing.T) {
+	upstream := &x509.Certificate{DNSNames: []string{"example.com", "example.org"}}
+	cert, err := generateCert(testSigner(t), "example.com", leafOptions{upstream: upstream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Leaf.DNSNames) != 2 || cert.Leaf.DNSNames[1] != "example.org" {
+		t.Errorf("Expected upstream SANs to be copied, but got %v", cert.Leaf.DNSNames)
+	}
+}
+
+func TestGenerateCertIPv6(t *testing.T) {
+	for _, host := range []string{"::1", "[::1]"} {
+		cert, err := GenerateCert(testCA(t), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.Leaf.DNSNames) != 0 {
+			t.Errorf("Expected: no DNS names, but got: %v", cert.Leaf.DNSNames)
+		}
+		if len(cert.Leaf.IPAddresses) != 1 || !cert.Leaf.IPAddresses[0].Equal(net.IPv6loopback) {
+			t.Errorf("Expected: [::1], but got: %v", cert.Leaf.IPAddresses)
+		}
+		if err := cert.Leaf.VerifyHostname("::1"); err != nil {
+			t.Errorf("Expected the certificate to be valid for ::1: %v", err)
+		}
+	}
+}
+
+// countingSigner counts the certificates it signs.
+type countingSigner struct {
+	CertSigner
+	count int
+}
+
+func (s *countingSigner) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	s.count++
+	return s.CertSigner.SignCertificate(template, pub)
+}
+
+func TestCustomSigner(t *testing.T) {
+	signer := &countingSigner{CertSigner: testSigner(t)}
+	p := NewProxy()
+	p.Signer = signer
+
+	s, err := p.signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.getCert(s, "example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if signer.count != 1 {
+		t.Errorf("Expected the custom signer to be used")
+	}
+}
+
+func TestLeafKeyType(t *testing.T) {
+	ecCert, ecKey, err := GenerateCA("ECDSA CA", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := map[string]tls.Certificate{"RSA": testCA(t)}
+	if cas["ECDSA"], err = tls.X509KeyPair(ecCert, ecKey); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		ca       string
+		keyType  KeyType
+		expected string
+	}{
+		{"RSA", KeyAuto, "RSA-2048"},
+		{"ECDSA", KeyAuto, "P-256"},
+		{"RSA", KeyECDSAP384, "P-384"},
+		{"RSA", KeyECDSAP256, "P-256"},
+		{"ECDSA", KeyRSA2048, "RSA-2048"},
+	}
+	for _, tc := range testCases {
+		ca := cas[tc.ca]
+		ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+		signer, err := tlsCertSigner(ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := generateCert(signer, "example.com", leafOptions{keyType: tc.keyType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result string
+		switch k := cert.Leaf.PublicKey.(type) {
+		case *rsa.PublicKey:
+			result = fmt.Sprintf("RSA-%d", k.N.BitLen())
+		case *ecdsa.PublicKey:
+			result = k.Curve.Params().Name
+		}
+		if result != tc.expected {
+			t.Errorf("Expected: %s, but got: %s with the %s CA", tc.expected, result, tc.ca)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Leaf)
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+			t.Errorf("Expected the leaf to be signed by the %s CA: %v", tc.ca, err)
+		}
+	}
+}
+
+func TestCertName(t *testing.T) {
+	signer := testSigner(t)
+	testCases := []struct {
+		wildcard bool
+		hosts    []string
+		name     string
+	}{
+		{false, []string{"example.com", "Example.COM."}, "example.com"},
+		{false, []string{"a.example.com"}, "a.example.com"},
+		{true, []string{"a.example.com", "B.example.com", "c.example.com."}, "*.example.com"},
+		{true, []string{"a.b.example.com"}, "*.b.example.com"},
+		{true, []string{"example.com"}, "example.com"},
+		{true, []string{"127.0.0.1"}, "127.0.0.1"},
+		{true, []string{"::1", "[::1]"}, "::1"},
+		// no wildcard over a public suffix
+		{true, []string{"bbc.co.uk"}, "bbc.co.uk"},
+		{true, []string{"www.bbc.co.uk", "news.bbc.co.uk"}, "*.bbc.co.uk"},
+		{true, []string{"foo.github.io"}, "foo.github.io"},
+		{true, []string{"a.foo.github.io"}, "*.foo.github.io"},
+	}
+	for _, tc := range testCases {
+		p := NewProxy()
+		p.UseWildcardCerts = tc.wildcard
+		var first *tls.Certificate
+		for _, host := range tc.hosts {
+			cert, err := p.getCert(signer, host, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = cert
+			} else if cert != first {
+				t.Errorf("Expected a single certificate for %v", tc.hosts)
+			}
+			if err := cert.Leaf.VerifyHostname(strings.TrimSuffix(host, ".")); err != nil {
+				t.Errorf("Expected the certificate to be valid for %s: %v", host, err)
+			}
+		}
+		if len(p.certCache) != 1 || p.certCache[tc.name] != first {
+			t.Errorf("Expected: %s, but got: %v", tc.name, p.certCache)
+		}
+		if first.Leaf.Subject.CommonName != tc.name {
+			t.Errorf("Expected: %s, but got: %s", tc.name, first.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestStartTlsWithClientWithoutSNI(t *testing.T) {
+	p := NewProxy()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the destination is not known, e.g. a transparent connection
+		if tlsConn, _, err := p.startTlsWithClient(conn, "", nil); err == nil {
+			tlsConn.Close()
+		}
+	}()
+
+	// no SNI is sent when connecting to an IP address
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("Expected the certificate to be valid for 127.0.0.1: %v", err)
+	}
+}
+
+func TestMirrorUpstream(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	upstream.StartTLS()
+	defer upstream.Close()
+	real := upstream.Certificate()
+	if _, ok := real.PublicKey.(*rsa.PublicKey); !ok {
+		t.Skipf("Expected an RSA certificate, but got: %T", real.PublicKey)
+	}
+
+	for _, mirror := range []bool{false, true} {
+		p, client, cleanup := NewTestProxy(t)
+		p.LeafKeyType = KeyECDSAP256
+		p.MirrorUpstream = mirror
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		cleanup()
+
+		leaf := resp.TLS.PeerCertificates[0]
+		ca := resp.TLS.PeerCertificates[len(resp.TLS.PeerCertificates)-1]
+		if len(resp.TLS.VerifiedChains) > 0 {
+			chain := resp.TLS.VerifiedChains[0]
+			ca = chain[len(chain)-1]
+		}
+		wantVersion := uint16(tls.VersionTLS13)
+		_, isRSA := leaf.PublicKey.(*rsa.PublicKey)
+		wantNotAfter := leaf.NotAfter
+		if mirror {
+			wantVersion = tls.VersionTLS12
+			wantNotAfter = real.NotAfter
+			if wantNotAfter.After(ca.NotAfter) {
+				wantNotAfter = ca.NotAfter
+			}
+		}
+		if resp.TLS.Version != wantVersion {
+			t.Errorf("mirror %v: Expected: %x, but got: %x", mirror, wantVersion, resp.TLS.Version)
+		}
+		if isRSA != mirror {
+			t.Errorf("mirror %v: Expected an RSA key: %v, but got: %T", mirror, mirror, leaf.PublicKey)
+		}
+		if !leaf.NotAfter.Equal(wantNotAfter) {
+			t.Errorf("mirror %v: Expected: %v, but got: %v", mirror, wantNotAfter, leaf.NotAfter)
+		}
+		if mirror && !containsString(leaf.DNSNames, real.DNSNames[0]) {
+			t.Errorf("Expected the SANs of the real certificate: %v, but got: %v", real.DNSNames, leaf.DNSNames)
+		}
+	}
+}
+
+func TestMirrorVersion(t *testing.T) {
+	tests := []struct {
+		min, max, version, want uint16
+	}{
+		{0, 0, tls.VersionTLS12, tls.VersionTLS12},
+		{0, 0, tls.VersionTLS13, tls.VersionTLS13},
+		// not accepted by the configuration, left alone
+		{0, 0, tls.VersionTLS10, 0},
+		{tls.VersionTLS13, 0, tls.VersionTLS12, 0},
+		{0, tls.VersionTLS12, tls.VersionTLS13, tls.VersionTLS12},
+		{tls.VersionTLS10, 0, tls.VersionTLS11, tls.VersionTLS11},
+	}
+	for _, tt := range tests {
+		conf := &tls.Config{MinVersion: tt.min, MaxVersion: tt.max}
+		mirrorVersion(conf, tt.version)
+		want := tt.want
+		if want == 0 {
+			want = tt.max
+		}
+		if conf.MaxVersion != want {
+			t.Errorf("%x-%x, %x: Expected: %x, but got: %x", tt.min, tt.max, tt.version, want, conf.MaxVersion)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package yves
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrTransparentUnsupported is returned when the original destination of a
+// connection cannot be recovered on this platform.
+var ErrTransparentUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+// getOriginalDst is replaced in the tests.
+var getOriginalDst = originalDst
+
+// ServeTransparent accepts on ln the connections redirected to the proxy by
+// iptables and serves them as if the client had asked the proxy to connect
+// to their original destination: TLS connections are intercepted, or
+// tunneled according to HandleConnect, and plaintext HTTP requests are
+// forwarded. It is only supported on Linux, where the original destination
+// is read with SO_ORIGINAL_DST, e.g. with:
+//
+//	iptables -t nat -A OUTPUT -p tcp --dport 443 -m owner ! --uid-owner proxy -j REDIRECT --to-ports 8080
+//
+// The connections of the proxy itself must not be redirected.
+func (p *Proxy) ServeTransparent(ln net.Listener) error {
+	p.connsMutex.Lock()
+	if p.shuttingDown {
+		p.connsMutex.Unlock()
+		ln.Close()
+		return ErrProxyClosed
+	}
+	p.listeners = append(p.listeners, ln)
+	p.connsMutex.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.isShuttingDown() {
+				return ErrProxyClosed
+			}
+			return err
+		}
+		go p.serveTransparent(conn)
+	}
+}
+
+func (p *Proxy) serveTransparent(conn net.Conn) {
+	ctx := p.newSession()
+	// a refused connection is neither tracked nor seen by the hooks
+	if !acquire(&p.counters.activeConnections, p.MaxConcurrentConnections) {
+		p.logger().Infof("[%d] Too many connections, refusing %s", ctx.Value("session"), conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer atomic.AddInt64(&p.counters.activeConnections, -1)
+	tracked, closeConn := p.trackConn(ctx, conn)
+	defer closeConn()
+	if !p.addConn(tracked) {
+		return
+	}
+	defer p.removeConn(tracked)
+
+	dst, err := getOriginalDst(conn)
+	if err != nil {
+		p.logger().Errorf("Cannot get the original destination: %v", err)
+		return
+	}
+	host := dst.String()
+	p.logger().Debugf("[%d] Transparent connection to %s from %s", ctx.Value("session"), host, conn.RemoteAddr())
+	// the connection counts as a CONNECT, the requests sent in it are
+	// limited one by one when they are read
+	if wait := p.rateLimited(conn.RemoteAddr().String(), strings.ToLower(host)); wait > 0 {
+		// the client may be speaking TLS, there is nobody to answer to
+		p.logger().Infof("[%d] Too many requests from %s to %s", ctx.Value("session"), conn.RemoteAddr(), host)
+		return
+	}
+
+	var clientConn net.Conn = &countingConn{Conn: tracked, read: &p.counters.bytesReceived, written: &p.counters.bytesSent}
+	switch action := p.connectAction(ctx, host); action.Action {
+	case ConnectReject:
+		return
+	case ConnectTunnel:
+		p.replayTunnel(ctx, clientConn, host, nil)
+		return
+	}
+
+	reader := bufio.NewReader(clientConn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	clientConn = &peekedConn{Conn: clientConn, r: reader}
+	// 0x16 is the type of the TLS record carrying the ClientHello
+	if first[0] != 0x16 {
+		if p.forbidHost(clientConn, host) {
+			return
+		}
+		p.serveRequests(ctx, clientConn, "http://"+host, nil)
+		return
+	}
+	if !p.hostAllowed(host) {
+		// there is nobody to answer to until the TLS handshake is done
+		p.logger().Infof("Connection to %s forbidden", host)
+		return
+	}
+	if p.TunnelOnHandshakeFailure && p.isFailedHost(host) {
+		p.replayTunnel(ctx, clientConn, host, nil)
+		return
+	}
+	p.serveTLS(ctx, clientConn, host, nil, true)
+}
+
+// peekedConn is a connection whose first bytes have been read in r.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
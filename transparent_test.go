@@ -0,0 +1,123 @@
+package yves
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeTransparent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	var tests = []struct {
+		name     string
+		upstream *httptest.Server
+		dial     func(addr string) (net.Conn, error)
+	}{
+		{"HTTP", httptest.NewServer(handler), func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}},
+		{"HTTPS", httptest.NewTLSServer(handler), func(addr string) (net.Conn, error) {
+			return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+		}},
+	}
+	defer func() { getOriginalDst = originalDst }()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer tc.upstream.Close()
+			// pretend the connections were redirected from the upstream
+			getOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+				return tc.upstream.Listener.Addr().(*net.TCPAddr), nil
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewProxy()
+			go p.ServeTransparent(ln)
+			defer p.Shutdown(context.Background())
+
+			conn, err := tc.dial(ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "hello" {
+				t.Errorf("Expected: hello, but got: %s", body)
+			}
+		})
+	}
+}
+
+func TestServeTransparentMaxConnections(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	defer func() { getOriginalDst = originalDst }()
+	getOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+		return upstream.Listener.Addr().(*net.TCPAddr), nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy()
+	p.MaxConcurrentConnections = 1
+	var opened, closed int32
+	p.OnConnOpen = func(info ConnInfo) { atomic.AddInt32(&opened, 1) }
+	p.OnConnClose = func(info ConnInfo) { atomic.AddInt32(&closed, 1) }
+	go p.ServeTransparent(ln)
+	defer p.Shutdown(context.Background())
+
+	// a connection kept open
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the next one is refused without being tracked
+	refused, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected: %v, but got: %v", io.EOF, err)
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Errorf("Expected: 1, but got: %d", n)
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Expected: 0, but got: %d", n)
+	}
+	p.connsMutex.Lock()
+	tracked := len(p.activeConns)
+	p.connsMutex.Unlock()
+	if tracked != 1 || p.Stats().ActiveConnections != 1 {
+		t.Errorf("Expected: 1, but got: %d %d", tracked, p.Stats().ActiveConnections)
+	}
+}
@@ -0,0 +1,42 @@
+package yves
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Connection pooling of the transport created by NewProxy. A proxy sends
+// the requests of many clients to the same hosts, so it keeps more idle
+// connections per host than http.DefaultTransport, which keeps only 2.
+const (
+	DefaultMaxIdleConns        = 512
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newTransport returns the transport used to forward the requests. Every
+// upstream TLS connection gets its own copy of TLSClientConfig, see
+// upstreamTLSConfig, so it can be changed for a single host without
+// affecting the other ones.
+// HTTP/2 is not attempted with the remote hosts: the TLS connections are
+// established by dialTLS, which does not offer h2, so that they can be
+// handed over from a CONNECT.
+func (p *Proxy) newTransport() *http.Transport {
+	return &http.Transport{
+		// By default skip TLS verification, see VerifyUpstream
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection:   p.verifyUpstream(""),
+		},
+		GetProxyConnectHeader: p.proxyConnectHeader,
+		DialContext:           p.dialContext,
+		DialTLSContext:        p.dialTLS,
+		MaxIdleConns:          DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:   DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       DefaultIdleConnTimeout,
+		// wait for the 100 Continue of the remote host before asking the
+		// client for the body, see expectContinue.
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,68 @@
+package yves
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	p := NewProxy()
+	if p.Tr.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost || p.Tr.MaxIdleConns != DefaultMaxIdleConns || p.Tr.IdleConnTimeout != DefaultIdleConnTimeout {
+		t.Errorf("Expected the default connection pooling, but got: %d %d %v", p.Tr.MaxIdleConnsPerHost, p.Tr.MaxIdleConns, p.Tr.IdleConnTimeout)
+	}
+
+	// the configuration of a host does not leak to the other ones
+	conf := p.upstreamTLSConfig("a.example.com:443")
+	conf.InsecureSkipVerify = false
+	if other := p.upstreamTLSConfig("b.example.com:443"); !other.InsecureSkipVerify || other.ServerName != "b.example.com" {
+		t.Errorf("Expected: an insecure config for b.example.com, but got: %v %s", other.InsecureSkipVerify, other.ServerName)
+	}
+	if p.Tr.TLSClientConfig.ServerName != "" || !p.Tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("Expected TLSClientConfig to be left untouched")
+	}
+}
+
+// BenchmarkConnectionReuse sends concurrent requests through the proxy and
+// reports how many connections are opened with the remote host.
+func BenchmarkConnectionReuse(b *testing.B) {
+	for _, idle := range []int{2, DefaultMaxIdleConnsPerHost} {
+		b.Run(fmt.Sprintf("MaxIdleConnsPerHost=%d", idle), func(b *testing.B) {
+			var conns int64
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			}))
+			upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			upstream.Start()
+			defer upstream.Close()
+
+			p, client, cleanup := NewTestProxy(b)
+			defer cleanup()
+			p.Tr.MaxIdleConnsPerHost = idle
+			client.Transport.(*http.Transport).MaxIdleConnsPerHost = 64
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(upstream.URL)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt64(&conns)), "upstream-conns")
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package yves
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrUpstreamProxyAuth is returned when the upstream proxy answers with
+// 407 Proxy Authentication Required. It may wrap the error of the transport,
+// check it with errors.Is.
+var ErrUpstreamProxyAuth = errors.New("upstream proxy authentication required")
+
+// BasicProxyAuth returns the value of a Proxy-Authorization header for
+// Basic authentication, to be used as UpstreamProxyAuth.
+func BasicProxyAuth(username, password string) string {
+	auth := username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+// upstreamConnectTimeout is how long the upstream proxy has to answer a
+// CONNECT.
+var upstreamConnectTimeout = 30 * time.Second
+
+// upstreamProxy returns the upstream proxy that the transport will use for req, if any.
+func (p *Proxy) upstreamProxy(req *http.Request) *url.URL {
+	if p.Tr == nil || p.Tr.Proxy == nil {
+		return nil
+	}
+	u, err := p.Tr.Proxy(req)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// httpsRequest returns a request to addr, used to ask Tr.Proxy which
+// upstream proxy to use for a CONNECT.
+func httpsRequest(addr string) *http.Request {
+	return &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: addr},
+		Header: http.Header{},
+	}
+}
+
+// dialUpstream opens a TCP connection with addr, tunneled through the
+// upstream proxy configured in Tr.Proxy if any.
+func (p *Proxy) dialUpstream(ctx context.Context, addr string) (net.Conn, error) {
+	if err := p.CircuitBreaker.allow(addr); err != nil {
+		return nil, err
+	}
+	conn, err := p.dialUpstreamConn(ctx, addr)
+	p.reportCircuit(addr, err)
+	return conn, err
+}
+
+func (p *Proxy) dialUpstreamConn(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL := p.upstreamProxy(httpsRequest(addr))
+	if proxyURL == nil {
+		return p.dialContext(ctx, "tcp", addr)
+	}
+	// the upstream proxy connects to addr, not the proxy
+	if err := p.checkPublic(ctx, addr); err != nil {
+		return nil, err
+	}
+	if isSOCKS5(proxyURL) {
+		return p.dialSOCKS5(ctx, proxyURL, addr)
+	}
+
+	conn, err := p.dial(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, _ := p.proxyConnectHeader(ctx, proxyURL, addr)
+	if u := proxyURL.User; u != nil && hdr.Get("Proxy-Authorization") == "" {
+		password, _ := u.Password()
+		hdr.Set("Proxy-Authorization", BasicProxyAuth(u.Username(), password))
+	}
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: hdr,
+	}
+	// an upstream proxy that never answers must not hold the client
+	deadline := time.Now().Add(upstreamConnectTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the body of the response is not read, the connection is either
+	// returned as the tunnel or closed.
+	switch resp.StatusCode {
+	case http.StatusOK:
+		conn.SetDeadline(time.Time{})
+		if br.Buffered() > 0 {
+			// what the destination sent along with the response, e.g.
+			// the banner of an SMTP server
+			return &peekedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	case http.StatusProxyAuthRequired:
+		conn.Close()
+		return nil, ErrUpstreamProxyAuth
+	}
+	conn.Close()
+	return nil, fmt.Errorf("upstream proxy: %s", resp.Status)
+}
+
+// isSOCKS5 tells whether proxyURL is a SOCKS5 proxy.
+func isSOCKS5(proxyURL *url.URL) bool {
+	return proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h"
+}
+
+// dialSOCKS5 opens a connection with addr through the SOCKS5 proxy at
+// proxyURL, authenticating with the credentials in the URL if any.
+func (p *Proxy) dialSOCKS5(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr(proxyURL), auth, forwardDialer{p})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// forwardDialer opens the connections with the SOCKS5 proxy.
+type forwardDialer struct {
+	p *Proxy
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.p.dial(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.p.dial(ctx, network, addr)
+}
+
+// upstreamProxyKey is the context key of the address of the upstream proxy
+// the transport dials for a request whose destination has been checked
+// with checkPublic.
+type upstreamProxyKey struct{}
+
+// proxyAddr returns the address of the upstream proxy at proxyURL, with the
+// default port of its scheme if missing.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	port := "80"
+	switch {
+	case isSOCKS5(proxyURL):
+		port = "1080"
+	case proxyURL.Scheme == "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// proxyConnectHeader is used as the transport GetProxyConnectHeader so that
+// the credentials are sent when tunneling through the upstream proxy.
+func (p *Proxy) proxyConnectHeader(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	hdr := http.Header{}
+	if p.UpstreamProxyAuth != "" {
+		hdr.Set("Proxy-Authorization", p.UpstreamProxyAuth)
+	}
+	return hdr, nil
+}
+
+// setUpstreamProxyAuth adds the credentials for the upstream proxy to a
+// plaintext request. HTTPS requests are tunneled with a CONNECT so the
+// credentials are added by proxyConnectHeader instead.
+func (p *Proxy) setUpstreamProxyAuth(req *http.Request) {
+	if p.UpstreamProxyAuth == "" || req.URL.Scheme != "http" {
+		return
+	}
+	if p.upstreamProxy(req) != nil {
+		req.Header.Set("Proxy-Authorization", p.UpstreamProxyAuth)
+	}
+}
+
+// checkUpstreamProxyAuth turns a 407 from the upstream proxy into ErrUpstreamProxyAuth.
+func (p *Proxy) checkUpstreamProxyAuth(req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		if isProxyAuthError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrUpstreamProxyAuth, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && p.upstreamProxy(req) != nil {
+		resp.Body.Close()
+		return nil, ErrUpstreamProxyAuth
+	}
+	return resp, nil
+}
+
+// isProxyAuthError tells whether err is the error returned by the transport
+// when the upstream proxy answers a CONNECT with 407, which is only the
+// status text of the response.
+func isProxyAuthError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err.Error() == http.StatusText(http.StatusProxyAuthRequired) {
+			return true
+		}
+	}
+	return false
+}
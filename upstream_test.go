@@ -0,0 +1,237 @@
+package yves
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamProxyAuth(t *testing.T) {
+	auth := BasicProxyAuth("user", "pass")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	p := NewProxy()
+	proxyUrl, _ := url.Parse(upstream.URL)
+	p.Tr.Proxy = http.ProxyURL(proxyUrl)
+	ctx := context.WithValue(context.Background(), "session", int64(0))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := p.forwardReq(ctx, req, "http://example.com"); !errors.Is(err, ErrUpstreamProxyAuth) {
+		t.Errorf("Expected: %v, but got %v", ErrUpstreamProxyAuth, err)
+	}
+
+	p.UpstreamProxyAuth = auth
+	req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := p.forwardReq(ctx, req, "http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected: 200, but got %d", resp.StatusCode)
+	}
+}
+
+func TestUpstreamProxyAuthConnect(t *testing.T) {
+	testCases := []struct {
+		reply    string
+		expected bool
+	}{
+		{"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", true},
+		{"HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", false},
+	}
+	for _, tc := range testCases {
+		p := NewProxy()
+		p.Tr.Proxy = http.ProxyURL(connectProxy(t, tc.reply))
+		ctx := context.WithValue(context.Background(), "session", int64(0))
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		_, err := p.forwardReq(ctx, req, "https://example.com")
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if errors.Is(err, ErrUpstreamProxyAuth) != tc.expected {
+			t.Errorf("Expected: %v, but got: %v", tc.expected, err)
+		}
+	}
+}
+
+// connectProxy is an upstream proxy answering every CONNECT with reply,
+// written at once. It returns the URL of the proxy.
+func connectProxy(t *testing.T, reply string) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, reply)
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func TestUpstreamProxyBanner(t *testing.T) {
+	p := NewProxy()
+	// the banner of the server comes in the same segment as the response
+	p.Tr.Proxy = http.ProxyURL(connectProxy(t, "HTTP/1.1 200 OK\r\n\r\n220 mail.example.com ESMTP\r\n"))
+	conn, err := p.dialUpstream(context.Background(), "mail.example.com:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || banner != "220 mail.example.com ESMTP\r\n" {
+		t.Errorf("Expected the banner, but got: %q %v", banner, err)
+	}
+}
+
+func TestUpstreamProxyConnectTimeout(t *testing.T) {
+	defer func(d time.Duration) { upstreamConnectTimeout = d }(upstreamConnectTimeout)
+	upstreamConnectTimeout = 100 * time.Millisecond
+
+	p := NewProxy()
+	// the proxy never answers
+	p.Tr.Proxy = http.ProxyURL(connectProxy(t, ""))
+	start := time.Now()
+	if _, err := p.dialUpstream(context.Background(), "example.com:443"); err == nil {
+		t.Errorf("Expected a timeout, but the tunnel was opened")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected the dial to give up, but it took %v", d)
+	}
+}
+
+// socks5Server is a minimal SOCKS5 server requiring user and pass as
+// credentials. It returns the address it listens on and the number of
+// connections it tunneled.
+func socks5Server(t *testing.T) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	count := new(int32)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 262)
+				// greeting: version, methods
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				io.ReadFull(c, buf[:buf[1]])
+				c.Write([]byte{5, 2})
+				// username and password
+				io.ReadFull(c, buf[:2])
+				user := make([]byte, buf[1])
+				io.ReadFull(c, user)
+				io.ReadFull(c, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(c, pass)
+				if string(user) != "user" || string(pass) != "pass" {
+					c.Write([]byte{1, 1})
+					return
+				}
+				c.Write([]byte{1, 0})
+				// request: version, cmd, reserved, address type
+				io.ReadFull(c, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(c, buf[:1])
+					name := make([]byte, buf[0])
+					io.ReadFull(c, name)
+					host = string(name)
+				default:
+					return
+				}
+				io.ReadFull(c, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				upstream, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+				if err != nil {
+					c.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				atomic.AddInt32(count, 1)
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, c)
+				io.Copy(c, upstream)
+			}(c)
+		}
+	}()
+	return ln.Addr().String(), count
+}
+
+func TestSOCKS5UpstreamProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(upstream.Config.Handler)
+	defer tlsUpstream.Close()
+
+	socksAddr, count := socks5Server(t)
+	p := NewProxy()
+	socksUrl, _ := url.Parse("socks5://user:pass@" + socksAddr)
+	p.Tr.Proxy = http.ProxyURL(socksUrl)
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for _, target := range []string{upstream.URL, tlsUpstream.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("Expected: hello, but got: %s", body)
+		}
+	}
+	// the HTTPS request goes through the CONNECT and the transport
+	if n := atomic.LoadInt32(count); n < 2 {
+		t.Errorf("Expected the connections to go through the SOCKS5 proxy, but got: %d", n)
+	}
+}
@@ -2,6 +2,8 @@ package yves
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/tls"
@@ -10,11 +12,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -46,9 +51,28 @@ const (
 	PongMessage = 10
 )
 
+// Direction is the direction of a websocket message.
+type Direction int
+
+const (
+	// ClientToServer is a message sent by the client to the server.
+	ClientToServer Direction = iota
+	// ServerToClient is a message sent by the server to the client.
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
 var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 
 // This is a websocket frame as per RFC6455 section-5.2
+// PayloadLength is the length of Data as read, Write uses len(Data) so that
+// Data can be replaced without updating it.
 type WebsocketFragment struct {
 	FinBit        bool
 	Rsv1          bool
@@ -61,6 +85,55 @@ type WebsocketFragment struct {
 	Data          []byte
 }
 
+// Close codes defined in RFC6455 section-7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseNoStatusReceived = 1005
+	CloseMessageTooBig    = 1009
+)
+
+// DefaultMaxWebsocketFrameSize is the default value of
+// Proxy.MaxWebsocketFrameSize.
+const DefaultMaxWebsocketFrameSize = 16 << 20
+
+// ErrWebsocketFrameTooBig is returned when a websocket frame, or a
+// reassembled message, is bigger than the maximum allowed size.
+var ErrWebsocketFrameTooBig = errors.New("websocket frame too big")
+
+// websocketCloseTimeout is how long the proxy waits for the answer to a
+// close frame before closing the connections.
+const websocketCloseTimeout = 5 * time.Second
+
+// errWebsocketClosed is returned by interceptWebsocket after a close frame
+// has been forwarded.
+var errWebsocketClosed = errors.New("websocket closed")
+
+// errWebsocketIdle is returned by interceptWebsocket when the websocket has
+// been idle for longer than Proxy.WebsocketIdleTimeout.
+var errWebsocketIdle = errors.New("websocket idle")
+
+// FormatCloseMessage formats code and text as the payload of a close message.
+// An empty payload is returned for CloseNoStatusReceived.
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	buf := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[2:], text)
+	return buf
+}
+
+// parseCloseMessage returns the code and the reason of a close message.
+func parseCloseMessage(data []byte) (int, string) {
+	if len(data) < 2 {
+		return CloseNoStatusReceived, ""
+	}
+	return int(binary.BigEndian.Uint16(data)), string(data[2:])
+}
+
 var ErrorMaskKeyLength = errors.New("mask key length must be exactly 4 bytes")
 
 func (frame *WebsocketFragment) Write(w io.Writer) error {
@@ -88,7 +161,7 @@ func (frame *WebsocketFragment) Write(w io.Writer) error {
 		secondByte |= maskBit
 	}
 
-	payloadLength := frame.PayloadLength
+	payloadLength := uint64(len(frame.Data))
 	if payloadLength < 126 {
 		secondByte |= byte(payloadLength)
 		header = append(header, secondByte)
@@ -110,53 +183,110 @@ func (frame *WebsocketFragment) Write(w io.Writer) error {
 		}
 		header = append(header, frame.Key...)
 	}
-	encryptedData := xorEncrypt(frame.Data, frame.Key)
-	header = append(header, encryptedData...)
+	if frame.MaskBit {
+		header = append(header, xorEncrypt(frame.Data, frame.Key)...)
+	} else {
+		header = append(header, frame.Data...)
+	}
 
 	if _, err := w.Write(header); err != nil {
-		return errors.New("writing header to the writer")
+		return fmt.Errorf("writing header to the writer: %w", err)
 	}
 
 	return nil
 }
 
-func (proxy *Proxy) serveWebsocket(w http.ResponseWriter, req *http.Request, clientConn net.Conn, isTls bool) {
+func (proxy *Proxy) serveWebsocket(ctx context.Context, req *http.Request, clientConn net.Conn, isTls bool) {
 
-	targetURL := url.URL{Scheme: "ws", Host: req.Host, Path: req.URL.Path}
+	targetURL := url.URL{Scheme: "ws", Host: websocketAddr(req.Host, isTls), Path: req.URL.Path}
 	if isTls {
-		targetURL = url.URL{Scheme: "wss", Host: req.Host + ":443", Path: req.URL.Path}
+		targetURL.Scheme = "wss"
+	}
+	if proxy.forbidHost(clientConn, targetURL.Host) {
+		return
 	}
+	ctx = context.WithValue(ctx, websocketHostKey{}, targetURL.Host)
 
-	targetConn, err := proxy.connectDial("tcp", targetURL.Host, isTls)
+	targetConn, err := proxy.connectDial(ctx, "tcp", targetURL.Host, isTls)
 	if err != nil {
-		log.Printf("Proxy connect dial error: %v\n", err)
+		proxy.logger().Errorf("Proxy connect dial error: %v", err)
+		HttpError(clientConn, err.Error(), errorStatus(err, http.StatusBadGateway))
 		return
 	}
 	defer targetConn.Close()
+	if tlsConn, ok := targetConn.(*tls.Conn); ok && inScope(ctx) {
+		state := tlsConn.ConnectionState()
+		proxy.handleUpstreamTLS(ctx, &state)
+	}
 
 	// Perform handshake with client and remote server
-	if err := proxy.websocketHandshake(req, targetConn, clientConn); err != nil {
-		log.Printf("Websocket handshake error: %v", err)
+	compressed, err := proxy.websocketHandshake(req, targetConn, clientConn)
+	if err != nil {
+		proxy.logger().Errorf("Websocket handshake error: %v", err)
 		return
 	}
 
+	proxy.logger().Debugf("Websocket handshake with %s completed", targetURL.Host)
+
 	// Proxy ws connection
-	proxy.proxyWebsocket(targetConn, clientConn)
+	proxy.proxyWebsocket(ctx, targetConn, clientConn, compressed)
 }
 
-func (proxy *Proxy) connectDial(network, addr string, isTls bool) (net.Conn, error) {
+// websocketAddr returns the address of host, adding the default port
+// of ws or wss, the same as http and https, if it is missing.
+func websocketAddr(host string, isTls bool) string {
 	if isTls {
-		return tls.Dial(network, addr, &tls.Config{})
+		return hostPort(host, "443")
 	}
-	return net.Dial(network, addr)
+	return hostPort(host, "80")
 }
 
-// complete the websocket handshare with the client and the target site.
-// handshare with the client performed by swtiching the protocol to websocket and computing the value for sec-websocket-accept
-// handshare with the server performed by asking protocol upgrading and checking that response is 101
-func (proxy *Proxy) websocketHandshake(req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) error {
-	secWebsocketKey := req.Header["Sec-Websocket-Key"][0]
-	secWebsocketAccept := computeAcceptKey(secWebsocketKey)
+// connectDial opens a connection with the websocket server at addr,
+// through the upstream proxy if there is one. The TLS connection opened
+// while handling the CONNECT is used if it has not been already.
+func (proxy *Proxy) connectDial(ctx context.Context, network, addr string, isTls bool) (net.Conn, error) {
+	if isTls {
+		if conn := proxy.takeUpstreamConn(addr); conn != nil {
+			return conn, nil
+		}
+	}
+	conn, err := proxy.dialUpstream(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if isTls {
+		conf := proxy.upstreamTLSConfig(addr)
+		// websockets are upgraded from HTTP/1.1 connections
+		conf.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+// complete the websocket handshake with the target site and the client.
+// handshake with the server performed by asking protocol upgrading and checking that response is 101
+// handshake with the client performed by swtiching the protocol to websocket and computing the value for sec-websocket-accept.
+// The subprotocol and the extensions requested by the client are forwarded
+// to the server, and the ones it selects are sent back to the client.
+// Only the permessage-deflate extension is supported, true is returned when
+// it has been negotiated.
+func (proxy *Proxy) websocketHandshake(req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) (bool, error) {
+	secWebsocketKey := req.Header.Get("Sec-WebSocket-Key")
+	if secWebsocketKey == "" {
+		HttpError(clientConn, errMissingWebsocketKey.Error(), http.StatusBadRequest)
+		return false, errMissingWebsocketKey
+	}
+
+	header, compressed, err := proxy.upgradeWebsocket(req, targetSiteConn)
+	if err != nil {
+		HttpError(clientConn, err.Error(), errorStatus(err, http.StatusBadGateway))
+		return false, err
+	}
 
 	response := &http.Response{
 		Status:     "101 Switch Protocol",
@@ -164,18 +294,24 @@ func (proxy *Proxy) websocketHandshake(req *http.Request, targetSiteConn io.Read
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     http.Header{},
+		Header:     header,
 	}
-	response.Header.Add("Sec-Websocket-Accept", secWebsocketAccept)
+	response.Header.Add("Sec-Websocket-Accept", computeAcceptKey(secWebsocketKey))
 	response.Header.Add("Connection", "Upgrade")
 	response.Header.Add("Upgrade", "websocket")
 
-	err := response.Write(clientConn)
-	if err != nil {
-		log.Printf("Error writing handshake response: %v", err)
-		return err
+	if err := response.Write(clientConn); err != nil {
+		proxy.logger().Errorf("Error writing handshake response: %v", err)
+		return false, err
 	}
+	return compressed, nil
+}
 
+// upgradeWebsocket sends the upgrade request of the websocket opened by req
+// to the server and waits for its 101. The headers of the answer meant for
+// the client are returned, along with whether permessage-deflate has been
+// negotiated.
+func (proxy *Proxy) upgradeWebsocket(req *http.Request, targetSiteConn io.ReadWriter) (http.Header, bool, error) {
 	// upgrade protocol request. Actually it probably containes all I need
 	// and I should just keep it the way it is
 	request := &http.Request{
@@ -194,21 +330,54 @@ func (proxy *Proxy) websocketHandshake(req *http.Request, targetSiteConn io.Read
 	websocketKey := generateWebSocketKey()
 	request.Header.Set("Sec-WebSocket-Key", websocketKey)
 	request.Header.Set("Sec-WebSocket-Version", "13")
+	copyHeader(request.Header, req.Header, "Sec-WebSocket-Protocol")
+	if hasExtension(req.Header, permessageDeflate) && !proxy.DisableWebsocketCompression {
+		// the parameters are dropped so that the defaults, which the proxy
+		// is able to handle, are used.
+		request.Header.Set("Sec-WebSocket-Extensions", permessageDeflate)
+	}
 
-	request.Write(targetSiteConn)
+	if err := request.Write(targetSiteConn); err != nil {
+		return nil, false, err
+	}
 
 	reader := bufio.NewReader(targetSiteConn)
 	target_site_response, err := http.ReadResponse(reader, nil)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 	if target_site_response.StatusCode != 101 {
-		return fmt.Errorf("upgrading connection")
+		return nil, false, fmt.Errorf("upgrading connection")
 	}
+	compressed := hasExtension(target_site_response.Header, permessageDeflate)
+
+	// keep the headers of the server, e.g. the subprotocol, the extensions
+	// and the cookies, but not the ones that only concern the connection
+	// with the server.
+	header := target_site_response.Header.Clone()
+	removeHopByHopHeaders(header)
+	header.Del("Sec-Websocket-Accept")
+	header.Del("Content-Length")
+	return header, compressed, nil
+}
 
-	return nil
+// copyHeader copies the values of the header name from src to dst.
+func copyHeader(dst, src http.Header, name string) {
+	for _, v := range src.Values(name) {
+		dst.Add(name, v)
+	}
 }
 
+var errMissingWebsocketKey = errors.New("missing Sec-WebSocket-Key header")
+
+// errWebsocketFrameLength is returned for a 64-bit payload length with the
+// most significant bit set.
+var errWebsocketFrameLength = errors.New("invalid websocket frame length")
+
+// websocketReadChunk is the size of the payload allocated before it is
+// read, it grows as the rest is received.
+const websocketReadChunk = 64 << 10
+
 // Helper function to generate a random Sec-WebSocket-Key
 func generateWebSocketKey() string {
 	// Generate 16 bytes of random data
@@ -219,112 +388,560 @@ func generateWebSocketKey() string {
 	return base64.StdEncoding.EncodeToString(key)
 }
 
-func (proxy *Proxy) proxyWebsocket(dest io.ReadWriter, source io.ReadWriter) {
+// proxyWebsocket proxies frames in both directions and returns as soon as
+// one of the two sides closes or breaks the connection, ctx is done, the
+// websocket is idle for longer than WebsocketIdleTimeout, or the proxy is
+// shut down. compressed tells whether permessage-deflate has been negotiated.
+func (proxy *Proxy) proxyWebsocket(ctx context.Context, dest io.ReadWriter, source io.ReadWriter, compressed bool) {
 	errChan := make(chan error, 2)
+	var activity *websocketActivity
+	if proxy.WebsocketIdleTimeout > 0 {
+		activity = newWebsocketActivity(proxy.WebsocketIdleTimeout)
+	}
+	// frames are written to each side by the intercept loops and the keepalive
+	destWriter := &websocketWriter{w: dest}
+	sourceWriter := &websocketWriter{w: source}
+	conns := &websocketConns{client: sourceWriter, server: destWriter}
+	session, _ := ctx.Value("session").(int64)
+	proxy.addWebsocket(session, conns)
+	defer proxy.removeWebsocket(session, conns)
+	var pingPayload []byte
+	if proxy.WebsocketPingInterval > 0 {
+		var err error
+		if pingPayload, err = newPingPayload(); err != nil {
+			proxy.logger().Errorf("Websocket ping error: %v", err)
+		} else {
+			done := make(chan struct{})
+			defer close(done)
+			go proxy.keepWebsocketAlive(proxy.WebsocketPingInterval, pingPayload, sourceWriter, destWriter, done)
+		}
+	}
 
 	// proxy from client to server
-	go proxy.interceptWebsocket(dest, source, proxy.HandleWebSocRequest)
+	go func() {
+		err := proxy.interceptWebsocket(ctx, ClientToServer, destWriter, source, proxy.websocketHandler(ctx, ClientToServer), compressed, activity, pingPayload)
+		if errors.Is(err, ErrWebsocketFrameTooBig) {
+			// tell the client why the connection is being closed
+			writeCloseFrame(sourceWriter, ServerToClient, CloseMessageTooBig)
+		}
+		errChan <- err
+	}()
 	// proxy from server to client
-	go proxy.interceptWebsocket(source, dest, proxy.HandleWebSocResponse)
-	<-errChan
+	go func() {
+		err := proxy.interceptWebsocket(ctx, ServerToClient, sourceWriter, dest, proxy.websocketHandler(ctx, ServerToClient), compressed, activity, pingPayload)
+		if errors.Is(err, ErrWebsocketFrameTooBig) {
+			writeCloseFrame(destWriter, ClientToServer, CloseMessageTooBig)
+		}
+		errChan <- err
+	}()
+
+	running := 2
+	select {
+	case err := <-errChan:
+		running--
+		switch {
+		case err == errWebsocketClosed:
+			// wait for the other side to answer the close frame
+			select {
+			case <-errChan:
+				running--
+			case <-time.After(websocketCloseTimeout):
+			case <-ctx.Done():
+			case <-proxy.shutdownSignal():
+			}
+		case err == errWebsocketIdle:
+			proxy.logger().Debugf("Closing idle websocket")
+			closeWebsocket(sourceWriter, ServerToClient, CloseGoingAway)
+			closeWebsocket(destWriter, ClientToServer, CloseGoingAway)
+		case err != io.EOF:
+			proxy.logger().Errorf("Websocket error: %v", err)
+		}
+	case <-ctx.Done():
+	case <-proxy.shutdownSignal():
+	}
+	// closing both connections makes the goroutines return
+	closeConn(dest)
+	closeConn(source)
+	for ; running > 0; running-- {
+		<-errChan
+	}
+}
+
+// websocketActivity keeps track of the last time a frame was read in either
+// direction of a websocket.
+type websocketActivity struct {
+	timeout time.Duration
+	last    int64 // unix nanoseconds, accessed atomically
+}
+
+func newWebsocketActivity(timeout time.Duration) *websocketActivity {
+	a := &websocketActivity{timeout: timeout}
+	a.touch()
+	return a
+}
+
+func (a *websocketActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// deadline returns when the websocket becomes idle.
+func (a *websocketActivity) deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last)).Add(a.timeout)
+}
+
+// waitFrame blocks until data is available on r, which reads from src. An
+// idle src is fine as long as frames are flowing in the other direction,
+// errWebsocketIdle is returned when the whole websocket is idle.
+func (a *websocketActivity) waitFrame(r *bufio.Reader, src io.Reader) error {
+	conn, ok := src.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return nil
+	}
+	for {
+		conn.SetReadDeadline(a.deadline())
+		_, err := r.Peek(1)
+		if err == nil {
+			break
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+		if !time.Now().Before(a.deadline()) {
+			return errWebsocketIdle
+		}
+	}
+	// a frame is coming, do not wait forever for the rest of it
+	conn.SetReadDeadline(time.Now().Add(a.timeout))
+	return nil
 }
 
-func (proxy *Proxy) interceptWebsocket(dst io.Writer, src io.Reader, handler func(*WebsocketFragment) *WebsocketFragment) {
+// websocketHandler returns the fragment handler for the direction dir,
+// which chains HandleWebSocRequest or HandleWebSocResponse and
+// HandleWebSocFragment. nil is returned when there are no handlers, or
+// when the websocket is out of Scope.
+func (proxy *Proxy) websocketHandler(ctx context.Context, dir Direction) func(*WebsocketFragment) *WebsocketFragment {
+	if !inScope(ctx) {
+		return nil
+	}
+	handler := proxy.HandleWebSocRequest
+	if dir == ServerToClient {
+		handler = proxy.HandleWebSocResponse
+	}
+	fragmentHandler := proxy.HandleWebSocFragment
+	if fragmentHandler == nil {
+		return handler
+	}
+	session, _ := ctx.Value("session").(int64)
+	return func(websoc *WebsocketFragment) *WebsocketFragment {
+		if handler != nil {
+			if websoc = handler(websoc); websoc == nil {
+				return nil
+			}
+		}
+		return fragmentHandler(session, dir, websoc)
+	}
+}
+
+// writeCloseFrame sends a close frame with code to w.
+func writeCloseFrame(w io.Writer, dir Direction, code int) error {
+	data := FormatCloseMessage(code, "")
+	return writeFragment(w, &WebsocketFragment{
+		FinBit:        true,
+		OpCode:        CloseMessage,
+		PayloadLength: uint64(len(data)),
+		Data:          data,
+	}, dir)
+}
+
+// closeWebsocket sends a close frame with code to w, giving up after
+// websocketCloseTimeout if the peer is not reading.
+func closeWebsocket(w io.Writer, dir Direction, code int) error {
+	if conn, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		conn.SetWriteDeadline(time.Now().Add(websocketCloseTimeout))
+	}
+	return writeCloseFrame(w, dir, code)
+}
+
+func closeConn(c io.ReadWriter) {
+	if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// interceptWebsocket reads frames from src and writes them to dst until an
+// error occurs. io.EOF is returned when src is closed cleanly.
+// When compressed is true and there are handlers, compressed messages are
+// reassembled and decompressed before being handed to the handlers.
+func (proxy *Proxy) interceptWebsocket(ctx context.Context, dir Direction, dst io.Writer, src io.Reader, handler func(*WebsocketFragment) *WebsocketFragment, compressed bool, activity *websocketActivity, pingPayload []byte) error {
+	session, _ := ctx.Value("session").(int64)
 	scanner := bufio.NewReader(src)
+	// fragments of a message that is being reassembled
+	var fragments []*WebsocketFragment
+	var messageSize uint64
+	maxSize := proxy.maxWebsocketFrameSize()
+	var decompressor *inflater
+	messageHandler := proxy.HandleWebSocMessage
+	closeHandler := proxy.HandleWebSocClose
+	frameObserver := proxy.OnWebsocketFrame
+	rules := proxy.matchingRules(RuleRequest, RuleBody, websocketHost(ctx))
+	if dir == ServerToClient {
+		rules = proxy.matchingRules(RuleResponse, RuleBody, websocketHost(ctx))
+	}
+	if !inScope(ctx) {
+		messageHandler, closeHandler, frameObserver, rules = nil, nil, nil, nil
+	}
+	reassemble := proxy.ReassembleWebsocket || messageHandler != nil || len(rules) > 0
+	if compressed && (handler != nil || messageHandler != nil || len(rules) > 0) {
+		decompressor = &inflater{}
+	}
 	for {
-		_, err := scanner.Peek(1)
+		if activity != nil {
+			if err := activity.waitFrame(scanner, src); err != nil {
+				if err == io.EOF || err == errWebsocketIdle {
+					return err
+				}
+				return fmt.Errorf("decoding websocket message: %w", err)
+			}
+		}
+		websocFrag, err := readWebsocketFragment(scanner, maxSize)
 		if err != nil {
 			if err == io.EOF {
-				continue
+				return err
 			}
+			return fmt.Errorf("decoding websocket message: %w", err)
 		}
-		websocFrag, err := ReadWebsocketFragment(scanner)
-		if err != nil {
-			log.Printf("Error decoding websocket message %v\n", err)
+		if pingPayload != nil && websocFrag.OpCode == PongMessage && bytes.Equal(websocFrag.Data, pingPayload) {
+			// answer to a ping of the proxy, the other side does not expect it
+			continue
+		}
+		if activity != nil {
+			activity.touch()
+		}
+		atomic.AddInt64(&proxy.counters.websocketFrames, 1)
+		if frameObserver != nil {
+			// a copy, the handlers can change the fragment afterwards
+			observed := *websocFrag
+			observed.Data = append([]byte(nil), websocFrag.Data...)
+			frameObserver(session, dir, &observed)
+		}
+
+		if (reassemble || decompressor != nil) && !isControlFrame(websocFrag) {
+			fragments = append(fragments, websocFrag)
+			messageSize += websocFrag.PayloadLength
+			if messageSize > maxSize {
+				return fmt.Errorf("reassembling websocket message: %w", ErrWebsocketFrameTooBig)
+			}
+			if !websocFrag.FinBit {
+				continue
+			}
+			message := joinFragments(fragments)
+			// Rsv1 is set on compressed messages
+			deflated := decompressor != nil && message.Rsv1
+			if deflated {
+				data, err := decompressor.inflate(message.Data, maxSize)
+				if err != nil {
+					return fmt.Errorf("decompressing websocket message: %w", err)
+				}
+				message.Data = data
+				message.PayloadLength = uint64(len(data))
+				message.Rsv1 = false
+			}
+			if handler != nil {
+				message = handler(message)
+			}
+			if message != nil && messageHandler != nil && isDataFrame(message) {
+				data := messageHandler(session, dir, message.OpCode, message.Data)
+				if data == nil {
+					message = nil
+				} else {
+					message.Data = data
+					message.PayloadLength = uint64(len(data))
+				}
+			}
+			if message != nil && len(rules) > 0 && isDataFrame(message) {
+				message.Data = applyRules(rules, message.Data, nil)
+				message.PayloadLength = uint64(len(message.Data))
+			}
+			if message != nil && deflated {
+				data, err := deflateMessage(message.Data)
+				if err != nil {
+					return fmt.Errorf("compressing websocket message: %w", err)
+				}
+				message.Data = data
+				message.PayloadLength = uint64(len(data))
+				message.Rsv1 = true
+			}
+			if message != nil {
+				if err := writeMessage(dst, splitMessage(message, fragments, proxy.WebsocketFragmentSize), dir); err != nil {
+					return fmt.Errorf("writing websocket message: %w", err)
+				}
+			}
+			fragments = nil
+			messageSize = 0
 			continue
 		}
 
+		// control frames can be interleaved with the fragments of a
+		// message, they are never buffered.
 		if handler != nil {
 			websocFrag = handler(websocFrag)
 		}
-		websocFrag.Write(dst)
+		if websocFrag == nil {
+			continue
+		}
+		if err := writeFragment(dst, websocFrag, dir); err != nil {
+			return fmt.Errorf("writing websocket message: %w", err)
+		}
+		if websocFrag.OpCode == CloseMessage {
+			// nothing can be sent after a close frame
+			if closeHandler != nil {
+				code, reason := parseCloseMessage(websocFrag.Data)
+				closeHandler(session, dir, code, reason)
+			}
+			return errWebsocketClosed
+		}
+	}
+}
 
-		if err != nil {
-			log.Printf("Error writing websocket message %v\n", err)
+// websocketWriter serializes the frames written to a websocket endpoint by
+// the intercept loop, the keepalive and InjectWebsocket, so that they are
+// never interleaved, and stops writing anything after a close frame. Every
+// frame is written with a single call to Write.
+type websocketWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (w *websocketWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(b)
+}
+
+func (w *websocketWriter) write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errWebsocketClosed
+	}
+	n, err := w.w.Write(b)
+	if len(b) > 0 && int(b[0]&0x0f) == CloseMessage {
+		w.closed = true
+	}
+	return n, err
+}
 
+// lockedWebsocketWriter writes to a websocketWriter whose mutex is held.
+type lockedWebsocketWriter struct {
+	*websocketWriter
+}
+
+func (w lockedWebsocketWriter) Write(b []byte) (int, error) {
+	return w.write(b)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection,
+// if it has one.
+func (w *websocketWriter) SetWriteDeadline(t time.Time) error {
+	if conn, ok := w.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// writeMessage writes the fragments of a message to dst. When dst is a
+// websocketWriter no other frame is written between the fragments.
+func writeMessage(dst io.Writer, fragments []*WebsocketFragment, dir Direction) error {
+	if w, ok := dst.(*websocketWriter); ok {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		dst = lockedWebsocketWriter{w}
+	}
+	for _, f := range fragments {
+		if err := writeFragment(dst, f, dir); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func ReadWebsocketFragment(b *bufio.Reader) (*WebsocketFragment, error) {
-	websocFrame := &WebsocketFragment{}
-	byteRead, err := b.ReadByte()
-	if err != nil {
-		return nil, err
+// writeFragment writes frame to dst masking it as required by RFC6455
+// section-5.3: frames sent to the server are masked with a new random key,
+// frames sent to the client are never masked.
+func writeFragment(dst io.Writer, frame *WebsocketFragment, dir Direction) error {
+	if dir == ClientToServer {
+		key := make([]byte, 4)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		frame.MaskBit = true
+		frame.Key = key
+	} else {
+		frame.MaskBit = false
+		frame.Key = nil
 	}
+	return frame.Write(dst)
+}
 
-	websocFrame.FinBit = int(byteRead&finalBit) != 0 // 1 bit
-	websocFrame.Rsv1 = int(byteRead&rsv1Bit) != 0    // 1 bit
-	websocFrame.Rsv2 = int(byteRead&rsv2Bit) != 0    // 1 bit
-	websocFrame.Rsv3 = int(byteRead&rsv3Bit) != 0    // 1 bit
-	websocFrame.OpCode = int(byteRead & 0x0f)        // 4 bit
+func (proxy *Proxy) maxWebsocketFrameSize() uint64 {
+	if proxy.MaxWebsocketFrameSize > 0 {
+		return uint64(proxy.MaxWebsocketFrameSize)
+	}
+	return DefaultMaxWebsocketFrameSize
+}
 
-	byteRead, err = b.ReadByte()
-	if err != nil {
+// isDataFrame tells whether frame is the first fragment of a text or binary message.
+func isDataFrame(frame *WebsocketFragment) bool {
+	return frame.OpCode == TextMessage || frame.OpCode == BinaryMessage
+}
+
+// isControlFrame tells whether frame is a close, ping or pong frame.
+func isControlFrame(frame *WebsocketFragment) bool {
+	return frame.OpCode >= CloseMessage
+}
+
+// joinFragments reassembles a fragmented message in a single final fragment.
+func joinFragments(fragments []*WebsocketFragment) *WebsocketFragment {
+	first := fragments[0]
+	message := &WebsocketFragment{
+		FinBit:  true,
+		Rsv1:    first.Rsv1,
+		Rsv2:    first.Rsv2,
+		Rsv3:    first.Rsv3,
+		OpCode:  first.OpCode,
+		MaskBit: first.MaskBit,
+		Key:     first.Key,
+	}
+	for _, f := range fragments {
+		message.Data = append(message.Data, f.Data...)
+	}
+	message.PayloadLength = uint64(len(message.Data))
+	return message
+}
+
+// splitMessage fragments message again. If size is greater than zero the
+// message is split in fragments of at most size bytes, otherwise the
+// boundaries of the original fragments are used.
+func splitMessage(message *WebsocketFragment, original []*WebsocketFragment, size int) []*WebsocketFragment {
+	var chunks [][]byte
+	data := message.Data
+	if size > 0 {
+		for len(data) > size {
+			chunks = append(chunks, data[:size])
+			data = data[size:]
+		}
+	} else {
+		for _, f := range original[:len(original)-1] {
+			if len(data) <= len(f.Data) {
+				break
+			}
+			chunks = append(chunks, data[:len(f.Data)])
+			data = data[len(f.Data):]
+		}
+	}
+	chunks = append(chunks, data)
+
+	fragments := make([]*WebsocketFragment, len(chunks))
+	for i, chunk := range chunks {
+		// reuse the masking of the original fragments
+		orig := original[len(original)-1]
+		if i < len(original) {
+			orig = original[i]
+		}
+		f := &WebsocketFragment{
+			FinBit:        i == len(chunks)-1,
+			OpCode:        ContinuationFrame,
+			MaskBit:       orig.MaskBit,
+			Key:           orig.Key,
+			PayloadLength: uint64(len(chunk)),
+			Data:          chunk,
+		}
+		if i == 0 {
+			f.OpCode = message.OpCode
+			f.Rsv1 = message.Rsv1
+			f.Rsv2 = message.Rsv2
+			f.Rsv3 = message.Rsv3
+		}
+		fragments[i] = f
+	}
+	return fragments
+}
+
+// ReadWebsocketFragment reads a frame from b, whatever its size. The
+// payload is allocated as it is read, not from the length announced by the
+// peer.
+func ReadWebsocketFragment(b *bufio.Reader) (*WebsocketFragment, error) {
+	return readWebsocketFragment(b, math.MaxUint64)
+}
+
+// readWebsocketFragment reads a frame from b. ErrWebsocketFrameTooBig is
+// returned, before reading the payload, if it is bigger than maxSize.
+func readWebsocketFragment(b *bufio.Reader, maxSize uint64) (*WebsocketFragment, error) {
+	websocFrame := &WebsocketFragment{}
+	var header [2]byte
+	if _, err := io.ReadFull(b, header[:]); err != nil {
 		return nil, err
 	}
 
-	websocFrame.MaskBit = int(byteRead&maskBit) != 0
-	payloadLength := uint64(byteRead & 0x7f)
+	websocFrame.FinBit = header[0]&finalBit != 0 // 1 bit
+	websocFrame.Rsv1 = header[0]&rsv1Bit != 0    // 1 bit
+	websocFrame.Rsv2 = header[0]&rsv2Bit != 0    // 1 bit
+	websocFrame.Rsv3 = header[0]&rsv3Bit != 0    // 1 bit
+	websocFrame.OpCode = int(header[0] & 0x0f)   // 4 bit
 
-	var lenn []byte
+	websocFrame.MaskBit = header[1]&maskBit != 0
+	payloadLength := uint64(header[1] & 0x7f)
+
+	var lenn [8]byte
 	switch payloadLength {
 	case 126:
-		lenn1, err := b.ReadByte()
-		if err != nil {
+		if _, err := io.ReadFull(b, lenn[:2]); err != nil {
 			return nil, err
 		}
-		lenn2, err := b.ReadByte()
-		if err != nil {
+		payloadLength = uint64(binary.BigEndian.Uint16(lenn[:2]))
+	case 127:
+		if _, err := io.ReadFull(b, lenn[:]); err != nil {
 			return nil, err
 		}
-		lenn = append(lenn, lenn1, lenn2)
-		payloadLength = uint64(binary.BigEndian.Uint16(lenn))
-	case 127:
-		for i := 0; i < 8; i++ {
-			l, err := b.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-			lenn = append(lenn, l)
+		payloadLength = binary.BigEndian.Uint64(lenn[:])
+		// the most significant bit must be 0, see RFC 6455 section 5.2
+		if payloadLength > math.MaxInt64 {
+			return nil, errWebsocketFrameLength
 		}
-		payloadLength = uint64(binary.BigEndian.Uint64(lenn))
 	}
 	websocFrame.PayloadLength = payloadLength
+	if payloadLength > maxSize {
+		return nil, ErrWebsocketFrameTooBig
+	}
 
 	key := make([]byte, 4)
 	if websocFrame.MaskBit {
-		for i := 0; i < 4; i++ {
-			k, err := b.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-			key[i] = k
+		if _, err := io.ReadFull(b, key); err != nil {
+			return nil, err
 		}
 	}
 	websocFrame.Key = key
 
-	data := make([]byte, 0)
-	for i := 0; uint64(i) < payloadLength; i++ {
-		c, err := b.ReadByte()
-		if err != nil {
-			return nil, err
+	// the length comes from the peer, do not allocate more than what
+	// has been received
+	var data bytes.Buffer
+	if payloadLength < websocketReadChunk {
+		data.Grow(int(payloadLength))
+	} else {
+		data.Grow(websocketReadChunk)
+	}
+	if _, err := io.CopyN(&data, b, int64(payloadLength)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		data = append(data, c)
+		return nil, err
+	}
+	payload := data.Bytes()
+	if websocFrame.MaskBit {
+		maskBytes(payload, key)
 	}
-	websocFrame.Data = xorEncrypt(data, websocFrame.Key)
+	websocFrame.Data = payload
 	return websocFrame, nil
-
 }
 
 func headerContains(header http.Header, name string, value string) bool {
@@ -343,6 +960,12 @@ func isWebSocketRequest(r *http.Request) bool {
 		headerContains(r.Header, "Upgrade", "websocket")
 }
 
+// isExtendedConnect tells whether r opens a websocket over HTTP/2, see
+// RFC 8441.
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
 func computeAcceptKey(key string) string {
 	// Create a new SHA-1 hash
 	h := sha1.New()
@@ -354,11 +977,21 @@ func computeAcceptKey(key string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// maskBytes masks or unmasks data in place. data is left untouched unless
+// key is a valid 4 bytes masking key.
+func maskBytes(data, key []byte) {
+	if len(key) != 4 {
+		return
+	}
+	for i := range data {
+		data[i] ^= key[i%4]
+	}
+}
+
+// xorEncrypt returns a masked copy of data, see maskBytes.
 func xorEncrypt(data, key []byte) []byte {
 	encrypted := make([]byte, len(data))
-	keyLen := len(key)
-	for i, b := range data {
-		encrypted[i] = b ^ key[i%keyLen]
-	}
+	copy(encrypted, data)
+	maskBytes(encrypted, key)
 	return encrypted
 }
@@ -0,0 +1,78 @@
+package yves
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// permessage-deflate is the websocket compression extension, see RFC7692.
+const permessageDeflate = "permessage-deflate"
+
+// maxWindowSize is the size of the LZ77 sliding window.
+const maxWindowSize = 1 << 15
+
+// deflateTail ends a compressed message: the empty block removed by the
+// sender followed by a final empty block, so that the reader hits io.EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// hasExtension tells whether the Sec-WebSocket-Extensions header contains
+// the extension name.
+func hasExtension(header http.Header, name string) bool {
+	for _, v := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(params[0]), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inflater decompresses the messages sent in one direction. The sender may
+// reference the previous messages, so the last decompressed bytes are kept.
+type inflater struct {
+	window []byte
+}
+
+// inflate decompresses data, ErrWebsocketFrameTooBig is returned if the
+// message is larger than maxSize once decompressed.
+func (i *inflater) inflate(data []byte, maxSize uint64) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)), i.window)
+	defer r.Close()
+	// a small message can decompress to gigabytes
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > maxSize {
+		return nil, ErrWebsocketFrameTooBig
+	}
+	i.window = append(i.window, out...)
+	if len(i.window) > maxWindowSize {
+		i.window = append([]byte(nil), i.window[len(i.window)-maxWindowSize:]...)
+	}
+	return out, nil
+}
+
+// deflateMessage compresses the payload of a message. A new compressor is
+// used for every message, which is always understood by the receiver
+// whatever context takeover was negotiated.
+func deflateMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	// the receiver adds back the trailing empty block
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4]), nil
+}
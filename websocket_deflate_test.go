@@ -0,0 +1,135 @@
+package yves
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestHasExtension(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected bool
+	}{
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"x-foo, Permessage-Deflate;server_no_context_takeover", true},
+		{"x-permessage-deflate", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		header := http.Header{"Sec-Websocket-Extensions": {tc.value}}
+		if got := hasExtension(header, permessageDeflate); got != tc.expected {
+			t.Errorf("%q: Expected: %v, but got: %v", tc.value, tc.expected, got)
+		}
+	}
+}
+
+func TestInterceptCompressedWebsocket(t *testing.T) {
+	// the sender keeps the compression context between messages
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	var src bytes.Buffer
+	for _, m := range []string{"hello hello hello", "hello hello world"} {
+		w.Write([]byte(m))
+		w.Flush()
+		data := bytes.TrimSuffix(compressed.Bytes(), deflateTail[:4])
+		compressed.Reset()
+		f := &WebsocketFragment{FinBit: true, Rsv1: true, OpCode: TextMessage, PayloadLength: uint64(len(data)), Data: data}
+		f.Write(&src)
+	}
+
+	proxy := NewProxy()
+	proxy.HandleWebSocMessage = func(session int64, dir Direction, msgType int, data []byte) []byte {
+		return bytes.ToUpper(data)
+	}
+	var dst bytes.Buffer
+	if err := proxy.interceptWebsocket(context.Background(), ServerToClient, &dst, &src, nil, true, nil, nil); err == nil || err.Error() != "EOF" {
+		t.Fatalf("Expected EOF, but got: %v", err)
+	}
+
+	r := bufio.NewReader(&dst)
+	receiver := &inflater{}
+	for _, expected := range []string{"HELLO HELLO HELLO", "HELLO HELLO WORLD"} {
+		f, err := ReadWebsocketFragment(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Rsv1 {
+			t.Errorf("Expected the message to be compressed")
+		}
+		data, err := receiver.inflate(f.Data, DefaultMaxWebsocketFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected: %s, but got: %s", expected, data)
+		}
+	}
+}
+
+func TestInflateTooBig(t *testing.T) {
+	// 1 MB of zeros compress to about 1 KB
+	data, err := deflateMessage(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var src bytes.Buffer
+	f := &WebsocketFragment{FinBit: true, Rsv1: true, OpCode: BinaryMessage, PayloadLength: uint64(len(data)), Data: data}
+	f.Write(&src)
+
+	proxy := NewProxy()
+	proxy.MaxWebsocketFrameSize = 64 << 10
+	proxy.HandleWebSocMessage = func(session int64, dir Direction, msgType int, data []byte) []byte {
+		t.Errorf("Expected the message not to be handled")
+		return data
+	}
+	err = proxy.interceptWebsocket(context.Background(), ServerToClient, io.Discard, &src, nil, true, nil, nil)
+	if !errors.Is(err, ErrWebsocketFrameTooBig) {
+		t.Errorf("Expected: %v, but got: %v", ErrWebsocketFrameTooBig, err)
+	}
+
+	if out, err := (&inflater{}).inflate(data, 1<<20); err != nil || len(out) != 1<<20 {
+		t.Errorf("Expected: %d, but got: %d (%v)", 1<<20, len(out), err)
+	}
+}
+
+func TestDisableWebsocketCompression(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/ws", nil)
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits")
+
+	for _, disable := range []bool{false, true} {
+		var sent, received, client bytes.Buffer
+		// the answer of the server is ready before it is asked
+		resp := &http.Response{StatusCode: 101, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}
+		resp.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+		resp.Write(&received)
+		server := struct {
+			io.Reader
+			io.Writer
+		}{&received, &sent}
+
+		proxy := NewProxy()
+		proxy.DisableWebsocketCompression = disable
+		if _, err := proxy.websocketHandshake(req, server, &client); err != nil {
+			t.Fatal(err)
+		}
+		upgrade, err := http.ReadRequest(bufio.NewReader(&sent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "permessage-deflate"
+		if disable {
+			expected = ""
+		}
+		if got := upgrade.Header.Get("Sec-WebSocket-Extensions"); got != expected {
+			t.Errorf("Expected: %q, but got: %q", expected, got)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package yves
+
+import "errors"
+
+// ErrNoWebsocket is returned by InjectWebsocket when there is no websocket
+// with the given session.
+var ErrNoWebsocket = errors.New("no websocket with this session")
+
+// websocketConns are the two ends of a websocket being proxied.
+type websocketConns struct {
+	client *websocketWriter
+	server *websocketWriter
+}
+
+func (p *Proxy) addWebsocket(session int64, conns *websocketConns) {
+	p.websocketsMutex.Lock()
+	defer p.websocketsMutex.Unlock()
+	if p.websockets == nil {
+		p.websockets = make(map[int64]*websocketConns)
+	}
+	p.websockets[session] = conns
+}
+
+func (p *Proxy) removeWebsocket(session int64, conns *websocketConns) {
+	p.websocketsMutex.Lock()
+	defer p.websocketsMutex.Unlock()
+	if p.websockets[session] == conns {
+		delete(p.websockets, session)
+	}
+}
+
+// InjectWebsocket sends frag on the websocket opened by the upgrade request
+// with the given session, to the server for ClientToServer and to the client
+// for ServerToClient. The frame is masked as needed. It is safe to call
+// InjectWebsocket from any goroutine, including the websocket handlers: the
+// frame is never written in the middle of another one, nor between the
+// fragments of a message reassembled by the proxy. Fragments forwarded one
+// by one are not reassembled, see ReassembleWebsocket. Nothing can be
+// injected once a close frame has been sent.
+func (p *Proxy) InjectWebsocket(session int64, frag *WebsocketFragment, dir Direction) error {
+	p.websocketsMutex.Lock()
+	conns := p.websockets[session]
+	p.websocketsMutex.Unlock()
+	if conns == nil {
+		return ErrNoWebsocket
+	}
+	w := conns.server
+	if dir == ServerToClient {
+		w = conns.client
+	}
+	// writeFragment sets the mask of the frame
+	f := *frag
+	f.PayloadLength = uint64(len(f.Data))
+	return writeFragment(w, &f, dir)
+}
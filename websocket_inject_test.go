@@ -0,0 +1,74 @@
+package yves
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInjectWebsocket(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyServer, server := net.Pipe()
+	defer server.Close()
+	proxy := NewProxy()
+
+	frag := &WebsocketFragment{FinBit: true, OpCode: TextMessage, Data: []byte("injected")}
+	if err := proxy.InjectWebsocket(5, frag, ClientToServer); err != ErrNoWebsocket {
+		t.Errorf("Expected: %v, but got: %v", ErrNoWebsocket, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.proxyWebsocket(context.WithValue(context.Background(), "session", int64(5)), proxyServer, proxyClient, false)
+		close(done)
+	}()
+	// wait for the websocket to be registered
+	for i := 0; ; i++ {
+		proxy.websocketsMutex.Lock()
+		registered := proxy.websockets[5] != nil
+		proxy.websocketsMutex.Unlock()
+		if registered {
+			break
+		}
+		if i == 100 {
+			t.Fatal("The websocket was never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	testCases := []struct {
+		dir    Direction
+		conn   net.Conn
+		masked bool
+	}{
+		{ClientToServer, server, true},
+		{ServerToClient, client, false},
+	}
+	for _, tc := range testCases {
+		errChan := make(chan error, 1)
+		go func(dir Direction) {
+			errChan <- proxy.InjectWebsocket(5, frag, dir)
+		}(tc.dir)
+		result, err := ReadWebsocketFragment(bufio.NewReader(tc.conn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errChan; err != nil {
+			t.Errorf("Expected: nil, but got: %v", err)
+		}
+		if string(result.Data) != "injected" || result.MaskBit != tc.masked {
+			t.Errorf("Expected: injected masked %v, but got: %s masked %v", tc.masked, result.Data, result.MaskBit)
+		}
+	}
+	if frag.MaskBit || frag.Key != nil {
+		t.Errorf("Expected the injected fragment not to be modified")
+	}
+
+	client.Close()
+	<-done
+	if err := proxy.InjectWebsocket(5, frag, ClientToServer); err != ErrNoWebsocket {
+		t.Errorf("Expected: %v, but got: %v", ErrNoWebsocket, err)
+	}
+}
@@ -0,0 +1,46 @@
+package yves
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+// newPingPayload returns the payload of the pings injected by the proxy,
+// the pongs carrying it are answers to those pings.
+func newPingPayload() ([]byte, error) {
+	payload := make([]byte, 8)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// keepWebsocketAlive sends a ping with payload to both the client and the
+// server every interval, until done is closed.
+func (proxy *Proxy) keepWebsocketAlive(interval time.Duration, payload []byte, client, server io.Writer, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		for _, peer := range []struct {
+			w   io.Writer
+			dir Direction
+		}{{client, ServerToClient}, {server, ClientToServer}} {
+			ping := &WebsocketFragment{
+				FinBit:        true,
+				OpCode:        PingMessage,
+				PayloadLength: uint64(len(payload)),
+				Data:          payload,
+			}
+			if err := writeFragment(peer.w, ping, peer.dir); err != nil && !errors.Is(err, errWebsocketClosed) {
+				proxy.logger().Debugf("Websocket ping error: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package yves
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// WebsocketRecorder writes the websocket frames going through a proxy to a
+// writer, one JSON object per line, as they are received. Frames are
+// correlated with the session id of the upgrade request, the same as in a
+// HarRecorder.
+type WebsocketRecorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	err   error
+}
+
+// NewWebsocketRecorder returns a WebsocketRecorder writing to w.
+func NewWebsocketRecorder(w io.Writer) *WebsocketRecorder {
+	return &WebsocketRecorder{enc: json.NewEncoder(w)}
+}
+
+// Install sets OnWebsocketFrame of p to the one of the recorder, replacing
+// the existing one.
+func (r *WebsocketRecorder) Install(p *Proxy) {
+	p.OnWebsocketFrame = r.OnWebsocketFrame
+}
+
+// OnWebsocketFrame records frag and the time it has been received. Nothing
+// is recorded anymore after a write error, see Err.
+func (r *WebsocketRecorder) OnWebsocketFrame(session int64, dir Direction, frag *WebsocketFragment) {
+	frame := websocketFrameRecord{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Session:   session,
+		Direction: dir.String(),
+		OpCode:    frag.OpCode,
+		Fin:       frag.FinBit,
+		Rsv1:      frag.Rsv1,
+		Length:    frag.PayloadLength,
+	}
+	frame.Payload, frame.Encoding = harText(frag.Data)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(frame)
+	}
+}
+
+// Err returns the error that stopped the recording, if any.
+func (r *WebsocketRecorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+type websocketFrameRecord struct {
+	Time      string `json:"time"`
+	Session   int64  `json:"session"`
+	Direction string `json:"direction"`
+	OpCode    int    `json:"opcode"`
+	Fin       bool   `json:"fin"`
+	Rsv1      bool   `json:"rsv1,omitempty"`
+	Length    uint64 `json:"length"`
+	Payload   string `json:"payload"`
+	Encoding  string `json:"encoding,omitempty"`
+}
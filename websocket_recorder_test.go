@@ -0,0 +1,76 @@
+package yves
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestWebsocketRecorder(t *testing.T) {
+	key := []byte{1, 2, 3, 4}
+	var src bytes.Buffer
+	for _, f := range []*WebsocketFragment{
+		{OpCode: TextMessage, MaskBit: true, Key: key, PayloadLength: 3, Data: []byte("hel")},
+		{OpCode: PingMessage, FinBit: true, MaskBit: true, Key: key, PayloadLength: 0},
+		{OpCode: ContinuationFrame, FinBit: true, MaskBit: true, Key: key, PayloadLength: 2, Data: []byte("lo")},
+		{OpCode: BinaryMessage, FinBit: true, MaskBit: true, Key: key, PayloadLength: 2, Data: []byte{0xff, 0xfe}},
+	} {
+		f.Write(&src)
+	}
+
+	var log bytes.Buffer
+	proxy := NewProxy()
+	NewWebsocketRecorder(&log).Install(proxy)
+	// the frames are recorded as received
+	proxy.HandleWebSocMessage = func(session int64, dir Direction, msgType int, data []byte) []byte {
+		return bytes.ToUpper(data)
+	}
+	var dst bytes.Buffer
+	if err := proxy.interceptWebsocket(context.WithValue(context.Background(), "session", int64(42)), ClientToServer, &dst, &src, nil, false, nil, nil); err == nil || err.Error() != "EOF" {
+		t.Fatalf("Expected EOF, but got: %v", err)
+	}
+
+	var expected = []websocketFrameRecord{
+		{Session: 42, Direction: "client->server", OpCode: TextMessage, Length: 3, Payload: "hel"},
+		{Session: 42, Direction: "client->server", OpCode: PingMessage, Fin: true},
+		{Session: 42, Direction: "client->server", OpCode: ContinuationFrame, Fin: true, Length: 2, Payload: "lo"},
+		{Session: 42, Direction: "client->server", OpCode: BinaryMessage, Fin: true, Length: 2, Payload: "//4=", Encoding: "base64"},
+	}
+	scanner := bufio.NewScanner(&log)
+	var i int
+	for ; scanner.Scan(); i++ {
+		var frame websocketFrameRecord
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+		}
+		if frame.Time == "" {
+			t.Errorf("Expected the time of the frame")
+		}
+		frame.Time = ""
+		if i < len(expected) && frame != expected[i] {
+			t.Errorf("Expected: %+v, but got: %+v", expected[i], frame)
+		}
+	}
+	if i != len(expected) {
+		t.Errorf("Expected: %d frames, but got: %d", len(expected), i)
+	}
+}
+
+func TestOnWebsocketFrameOutOfScope(t *testing.T) {
+	var src bytes.Buffer
+	(&WebsocketFragment{OpCode: TextMessage, FinBit: true, PayloadLength: 2, Data: []byte("hi")}).Write(&src)
+
+	proxy := NewProxy()
+	var frames int
+	proxy.OnWebsocketFrame = func(session int64, dir Direction, frag *WebsocketFragment) {
+		frames++
+	}
+	ctx := context.WithValue(context.WithValue(context.Background(), "session", int64(1)), outOfScopeKey{}, true)
+	var dst bytes.Buffer
+	proxy.interceptWebsocket(ctx, ServerToClient, &dst, &src, nil, false, nil, nil)
+	if frames != 0 {
+		t.Errorf("Expected: 0, but got: %d", frames)
+	}
+}
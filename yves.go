@@ -6,14 +6,18 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 var okHeader = "HTTP/1.1 200 OK\r\n\r\n"
@@ -25,258 +29,1258 @@ type Proxy struct {
 	// Tr is the transport used by the HttpClient
 	Tr *http.Transport
 
-	// HandleRequest is a function that is executed upon receving a request
+	// Logger is used to log what happens while serving clients.
+	// Nothing is logged if nil.
+	Logger Logger
+
+	// DialTimeout is the maximum amount of time a dial to a remote host
+	// waits for a connection to complete. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// Dialer, if set, is used instead of net.Dialer to open the connections
+	// with the remote hosts, both for HTTP forwarding and websockets.
+	// DialTimeout is ignored when Dialer is set.
+	Dialer func(network, addr string) (net.Conn, error)
+
+	// UpstreamProxyAuth is the value of the Proxy-Authorization header sent
+	// to the upstream proxy configured in Tr.Proxy, see BasicProxyAuth.
+	UpstreamProxyAuth string
+
+	// RequireAuth, if set, makes the clients authenticate with Basic
+	// authentication before using the proxy. It is called with the
+	// credentials sent in the Proxy-Authorization header of every request
+	// and CONNECT, and returns whether they are valid. Clients sending wrong
+	// or no credentials get a 407. Clients of ServeTransparent are never
+	// asked to authenticate.
+	RequireAuth func(user, pass string) bool
+
+	// AllowHosts, if not empty, are the only destinations the proxy connects
+	// to. DenyHosts are the destinations the proxy never connects to, even
+	// if they are allowed. Both contain glob patterns matched against the
+	// host name, e.g. *.example.com, or CIDR ranges, e.g. 10.0.0.0/8.
+	// Clients get a 403 for the destinations that are not allowed.
+	AllowHosts []string
+	DenyHosts  []string
+
+	// BlockPrivateNetworks forbids connections to loopback, link-local and
+	// private addresses, e.g. 127.0.0.1 or the 169.254.169.254 metadata
+	// endpoint of cloud providers. Host names are resolved once and the
+	// resolved address is dialed, so that a DNS answer changing in the
+	// meantime cannot be used to reach those addresses. AllowPrivateHosts
+	// are glob patterns or CIDR ranges, like AllowHosts, that can be
+	// reached anyway. Clients get a 403. With an upstream proxy, the
+	// destinations are checked rather than the upstream proxy.
+	BlockPrivateNetworks bool
+	AllowPrivateHosts    []string
+
+	// RequestTimeout is the time limit for a request forwarded to the remote
+	// host, including reading the response body. It can be changed for a
+	// single request from HandleRequest with SetTimeout. Zero means no
+	// timeout. NewProxy sets it to DefaultRequestTimeout.
+	RequestTimeout time.Duration
+
+	// RetryPolicy, if set, makes the proxy retry the idempotent requests
+	// that failed because of a transient error. The retries are bounded by
+	// RequestTimeout.
+	RetryPolicy *RetryPolicy
+
+	// CircuitBreaker, if set, makes the requests and the CONNECT to a remote
+	// host that keeps failing fail right away with a 503.
+	CircuitBreaker *CircuitBreaker
+
+	// ClientRateLimit and HostRateLimit, if set, limit the number of
+	// requests, CONNECT and websocket upgrades of each client IP and to
+	// each remote host, including the requests sent inside the tunnels.
+	// The clients over the limit get a 429.
+	ClientRateLimit *RateLimit
+	HostRateLimit   *RateLimit
+
+	// MaxConcurrentConnections and MaxConcurrentRequests limit the number of
+	// client connections served and of requests forwarded at once, zero
+	// means no limit. The connections and requests over the limit get a 503
+	// right away.
+	MaxConcurrentConnections int
+	MaxConcurrentRequests    int
+
+	// HandleRequest is a function that is executed upon receving a request.
+	// The URL of the request is always absolute, with the scheme and the
+	// host of the destination, also for requests received in a CONNECT tunnel.
+	// If it returns a response, see NewResponse, the request is not sent to
+	// the remote host and the response is sent to the client instead.
+	// Otherwise the changes made to the request are forwarded: the proxy
+	// sends a copy of it, without the hop-by-hop headers, leaving the
+	// request seen by the handler untouched.
+	// For the intercepted TLS connections req.TLS is the state of the
+	// connection with the client: version, cipher suite, ALPN protocol and
+	// SNI.
+	// Returning DropResponse resets the connection with the client instead.
 	HandleRequest func(int64, *http.Request) *http.Response
 
-	// HandleResponse is a function that is executed when a response is being sent back
+	// ModifyRequestHeaders and ModifyResponseHeaders are meant to change
+	// the headers only, e.g. to add CORS headers. They are executed after
+	// HandleRequest and HandleResponse, and before the header rules, the
+	// intercept queue and the body handlers: the body has not been read yet.
+	ModifyRequestHeaders  func(session int64, req *http.Request)
+	ModifyResponseHeaders func(session int64, resp *http.Response)
+
+	// StripHSTS removes Strict-Transport-Security from the responses, before
+	// ModifyResponseHeaders, so that the clients keep using plain HTTP for
+	// the hosts visited that way.
+	StripHSTS bool
+
+	// RewriteTarget, if set, is executed after the request handlers and
+	// returns where the request is actually sent, e.g. "api.staging.com" or
+	// "http://127.0.0.1:8080", or "" to leave it alone. The Host header is
+	// set to the new host unless PreserveHost is set. The name sent in the
+	// SNI and verified with VerifyUpstream is the one of the new host.
+	// The CONNECT and the tunnels still go to the host asked by the client.
+	// AllowHosts, DenyHosts and BlockPrivateNetworks apply to the new host,
+	// the client gets a 403 with ErrHostNotAllowed otherwise.
+	RewriteTarget func(session int64, req *http.Request) string
+	PreserveHost  bool
+
+	// HandleConnect is executed upon receiving a CONNECT request for host
+	// and decides whether the connection is intercepted, tunneled without
+	// decrypting it, or rejected. By default connections are intercepted.
+	HandleConnect func(session int64, host string) ConnectAction
+
+	// HandleTunnel relays the bytes of the connections that are not
+	// intercepted, tunneled CONNECTs and protocols other than HTTP,
+	// between client, the connection with the client, and server, the one
+	// with host. Both connections are closed when it returns. By default
+	// the bytes are copied in both directions until both sides are done:
+	// when one side stops sending, the other one is half-closed.
+	// HandleTunnel has to half-close them itself, with the CloseWrite
+	// method of the connections, otherwise a side gets EOF only once it
+	// returns.
+	HandleTunnel func(session int64, host string, client, server io.ReadWriter)
+
+	// TLSPassthroughHosts are the hosts whose connections are never
+	// intercepted but tunneled to the real server, e.g. apps pinning their
+	// certificates. They contain glob patterns or CIDR ranges, like
+	// AllowHosts, matched against the destination of the CONNECTs and
+	// against the SNI sent by the clients, which also makes them work with
+	// ServeTransparent.
+	TLSPassthroughHosts []string
+
+	// TunnelOnHandshakeFailure makes the proxy tunnel the connections it
+	// cannot intercept. When the certificate for a host cannot be generated
+	// the connection is tunneled to the real server; when a client refuses
+	// the certificate, the following connections to that host are tunneled.
+	TunnelOnHandshakeFailure bool
+
+	// ClientTLSConfig, if set, is the base of the TLS configuration of the
+	// connections with the clients, e.g. to pin the TLS versions or offer
+	// legacy cipher suites. Certificates, GetCertificate and
+	// GetConfigForClient are ignored, the certificates are always generated;
+	// NextProtos defaults to h2 and http/1.1. Unset, the defaults of
+	// crypto/tls are used.
+	ClientTLSConfig *tls.Config
+
+	failedHosts      map[string]bool
+	failedHostsMutex sync.Mutex
+
+	// upstreamConns are the TLS connections established with the
+	// destination of a CONNECT, waiting to be used by the transport.
+	upstreamConns      map[string][]net.Conn
+	upstreamConnsMutex sync.Mutex
+
+	// hijacked connections being served, see Shutdown.
+	activeConns  map[net.Conn]struct{}
+	connsWG      sync.WaitGroup
+	connsMutex   sync.Mutex
+	shuttingDown bool
+	done         chan struct{}
+
+	// websockets being proxied by session, see InjectWebsocket.
+	websockets      map[int64]*websocketConns
+	websocketsMutex sync.Mutex
+
+	// servers started by Serve, stopped by Shutdown.
+	servers   []*http.Server
+	listeners []net.Listener
+
+	// ReadHeaderTimeout and IdleTimeout configure the server started by
+	// Serve. DefaultReadHeaderTimeout and DefaultIdleTimeout are used if zero.
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+
+	// HandleResponse is a function that is executed when a response is being sent back.
+	// It gets the request as the client sent it, before HandleRequest, with
+	// an absolute URL like HandleRequest; resp.Request is the request sent
+	// to the remote host. The body of the request replays what has been
+	// sent, up to MaxBodyBufferSize, and req.GetBody returns it again.
+	// ResponseTiming tells when the request was received and forwarded.
+	// When resp.Body is replaced, the length of the new body is fixed, as
+	// well as Content-MD5 and ETag, but Content-Encoding is left as it is.
 	HandleResponse func(int64, *http.Request, *http.Response)
 
+	// StreamResponse is executed after HandleResponse, when it returns true
+	// the response body is streamed to the client as it is received and
+	// HandleResponseBody is not called. Server-Sent Events are always streamed.
+	StreamResponse func(int64, *http.Response) bool
+
+	// HandleRequestBody is executed after HandleRequest with the fully read
+	// request body. The returned body replaces the original one and
+	// Content-Length is fixed accordingly, like Content-MD5 and ETag if
+	// they are there. Returning nil or the same body leaves the request
+	// untouched.
+	HandleRequestBody func(int64, *http.Request, []byte) []byte
+
+	// HandleResponseBody is executed after HandleResponse with the fully read
+	// response body. It works like HandleRequestBody.
+	HandleResponseBody func(int64, *http.Response, []byte) []byte
+
+	// MaxBodyBufferSize is the maximum number of bytes of a body that is kept
+	// in memory for the body handlers. Bodies bigger than this are forwarded
+	// without calling the body handlers. Defaults to DefaultMaxBodyBufferSize.
+	MaxBodyBufferSize int64
+
+	// RequestIDHeader, if set, is the name of a header added to the
+	// requests sent to the remote hosts and to the responses sent to the
+	// clients, e.g. X-Yves-Request-Id, with the session id of the request,
+	// to correlate them with the logs of the proxy.
+	RequestIDHeader string
+
+	// DumpHTTP makes the proxy log, at the debug level, the requests sent to
+	// the remote hosts and the responses they send back, headers only, as
+	// they are on the wire. DumpBodySize is how many bytes of the bodies are
+	// logged too, once they have been read; binary bodies are hex dumped.
+	DumpHTTP     bool
+	DumpBodySize int64
+
+	// ForwardedHeaders makes the proxy add the address of the clients to the
+	// X-Forwarded-For and Forwarded headers of the requests, after the ones
+	// already there, and set X-Forwarded-Proto to http or https depending
+	// on how the clients sent them. Unset, the proxy is transparent to the
+	// remote hosts.
+	ForwardedHeaders bool
+
+	// MaxRequestBodySize is the maximum size of the body of the requests,
+	// the clients get a 413 for bigger bodies, and their connection is
+	// closed. A request announcing a bigger Content-Length is rejected
+	// before anything is read, otherwise the limit is hit while reading the
+	// body, either by the body handlers, which never see a body that is
+	// too large, or while forwarding it, in which case the remote host only
+	// gets part of it. Zero means no limit.
+	MaxRequestBodySize int64
+
+	// DecodeResponseBody makes the proxy decode the responses according to
+	// their Content-Encoding before calling the response handlers. Decoded
+	// responses are sent to the client without Content-Encoding and with a
+	// weak ETag.
+	DecodeResponseBody bool
+
+	// ContentDecoders adds decoders for content encodings, e.g. br, or
+	// replaces the default gzip and deflate ones. Used with DecodeResponseBody.
+	ContentDecoders map[string]ContentDecoder
+
+	// InterceptRequest and InterceptResponse select the requests, after
+	// HandleRequest, and the responses, after HandleResponse, that are held
+	// until they are forwarded, edited or dropped from the channel returned
+	// by Intercepted. Streamed responses, see StreamResponse, and the
+	// responses with a body larger than MaxBodyBufferSize are never held.
+	InterceptRequest  func(session int64, req *http.Request) bool
+	InterceptResponse func(session int64, resp *http.Response) bool
+	intercepted       chan *InterceptedItem
+	interceptedOnce   sync.Once
+
+	// HandleUpstreamTLS is executed, before HandleResponse, with the state
+	// of the TLS connection with the remote host: the negotiated version
+	// and cipher suite, and the certificates presented by the real server.
+	// It is also executed for wss websockets. The state is also available
+	// as resp.TLS from HandleResponse.
+	HandleUpstreamTLS func(session int64, state tls.ConnectionState)
+
+	// VerifyUpstream makes the proxy verify the certificates of the remote
+	// hosts against the system roots, or Tr.TLSClientConfig.RootCAs if set,
+	// whatever Tr.TLSClientConfig.InsecureSkipVerify says. Clients get a 502
+	// when a certificate is not valid. Through an upstream proxy the name
+	// of the host is taken from the SNI, so hosts reached by IP address
+	// cannot be verified. Tr.TLSClientConfig can be changed but must not be
+	// replaced, it carries the verification.
+	VerifyUpstream bool
+
+	// InsecureHosts are the hosts whose certificates are not verified when
+	// VerifyUpstream is set. They contain glob patterns or CIDR ranges, see
+	// AllowHosts.
+	InsecureHosts []string
+
+	// Scope limits the handlers, the rules and the interception to the
+	// requests it contains, the other ones are forwarded untouched. nil
+	// means every request.
+	Scope *Scope
+
+	// rules are the match and replace rules, see AddRule.
+	rules      []*MatchReplaceRule
+	rulesMutex sync.RWMutex
+
 	// Session is used to count the number of requests received
 	// so that it is possible to correlate requests and responses from the handlers.
 	session      int64
 	sessionMutex sync.Mutex
 
+	// counters are returned by Stats.
+	counters counters
+
 	// CaKey and CaCert are, respectively the proxy TLS private
 	// key and certificate in PEM format.
 	CaKey  []byte
 	CaCert []byte
 
+	// Signer, if set, signs the generated certificates instead of
+	// CaCert and CaKey.
+	Signer CertSigner
+
+	// certCache mantains the certificates that have already been created
+	// for this proxy. It is protected by certMutex since TLS handshakes
+	// with different clients happen concurrently.
+	certCache map[string]*tls.Certificate
+	certMutex sync.RWMutex
+	// certCalls are the certificates being generated, by host, also
+	// protected by certMutex.
+	certCalls map[string]*certCall
+
+	// LeafMaxAge is the validity of the generated certificates, 24 hours
+	// if zero.
+	LeafMaxAge time.Duration
+
+	// UseWildcardCerts makes the proxy generate a single wildcard
+	// certificate for the hosts of the same domain, e.g. *.example.com for
+	// both a.example.com and b.example.com, instead of one for each host.
+	UseWildcardCerts bool
+
+	// LeafKeyType is the type of the keys of the generated certificates.
+	// By default it is the same as the type of the key of the CA, e.g.
+	// RSA-2048 for an RSA CA.
+	LeafKeyType KeyType
+
+	// LeafKeyPoolSize is the number of keys for the generated certificates
+	// that are generated in advance, in the background, so that a new
+	// certificate only costs its signature. Zero disables the pool.
+	LeafKeyPoolSize int
+	// keyPools are the pools of keys by type, protected by certMutex.
+	keyPools map[KeyType]*keyPool
+
+	// CopyUpstreamSANs makes the generated certificates contain the subject
+	// alternative names of the certificate presented by the real server.
+	CopyUpstreamSANs bool
+
+	// MirrorUpstream makes the intercepted connections look like the ones
+	// with the real servers: the generated certificates have the subject
+	// alternative names, the validity, within the one of the CA, and the
+	// type of key of the certificate of the real server, and the clients
+	// cannot negotiate a TLS version newer than the one of the real server.
+	// LeafMaxAge and LeafKeyType apply to the other certificates.
+	MirrorUpstream bool
+
+	// CertCacheDir, if set, is the directory where newly generated
+	// certificates are saved. See LoadCertCache and SaveCertCache.
+	CertCacheDir string
+
 	HandleWebSocRequest  func(websoc *WebsocketFragment) *WebsocketFragment
 	HandleWebSocResponse func(websoc *WebsocketFragment) *WebsocketFragment
+
+	// HandleWebSocFragment is executed for the websocket fragments in both
+	// directions, after HandleWebSocRequest or HandleWebSocResponse, with
+	// the session of the upgrade request. Returning nil drops the fragment.
+	HandleWebSocFragment func(session int64, direction Direction, websoc *WebsocketFragment) *WebsocketFragment
+
+	// OnWebsocketFrame is executed for every websocket frame received, in
+	// both directions, before any other websocket handler, with the session
+	// of the upgrade request. It only observes the frames: frag is a copy,
+	// unmasked but still compressed if permessage-deflate is used, see
+	// WebsocketRecorder.
+	OnWebsocketFrame func(session int64, direction Direction, frag *WebsocketFragment)
+
+	// ReassembleWebsocket makes the websocket handlers receive whole messages
+	// instead of single fragments. Fragmented messages are buffered until
+	// the final fragment is received, and are fragmented again before being
+	// forwarded. Control frames are never buffered.
+	ReassembleWebsocket bool
+
+	// HandleWebSocClose is executed when a close frame is forwarded, with
+	// the close code and reason. The connections are closed once the other
+	// side answers with its own close frame.
+	HandleWebSocClose func(session int64, direction Direction, code int, reason string)
+
+	// HandleWebSocMessage is executed for every text or binary websocket
+	// message, after the fragment handlers, with the
+	// whole payload of the message. The returned payload is masked and
+	// fragmented as needed before being forwarded, returning nil drops the
+	// message. msgType is either TextMessage or BinaryMessage.
+	HandleWebSocMessage func(session int64, direction Direction, msgType int, data []byte) []byte
+
+	// DisableWebsocketCompression removes the permessage-deflate extension
+	// from the websocket handshakes, so that messages are never compressed.
+	// Otherwise compressed messages are decompressed before being handed
+	// to the websocket handlers and compressed again afterwards.
+	DisableWebsocketCompression bool
+
+	// WebsocketFragmentSize is the maximum size of the fragments of a
+	// reassembled message. If zero, the original fragment boundaries are kept.
+	WebsocketFragmentSize int
+
+	// MaxWebsocketFrameSize is the maximum size of a websocket frame, and of
+	// a reassembled or decompressed message. The connection is closed with the code
+	// CloseMessageTooBig when a peer sends a bigger frame. Defaults to
+	// DefaultMaxWebsocketFrameSize.
+	MaxWebsocketFrameSize int64
+
+	// WebsocketIdleTimeout closes websockets on which no frame has been
+	// sent in either direction for this long, with the code CloseGoingAway.
+	// Zero means no timeout.
+	WebsocketIdleTimeout time.Duration
+
+	// OnConnOpen and OnConnClose are executed when the proxy starts serving
+	// a connection with a client and once it is closed, whatever the reason.
+	// OnConnClose also gets the duration of the connection and the bytes
+	// exchanged with the client, tunnels and websockets included.
+	OnConnOpen  func(info ConnInfo)
+	OnConnClose func(info ConnInfo)
+
+	// WebsocketPingInterval makes the proxy send a ping to both ends of
+	// each websocket at this interval, so that idle websockets are not
+	// dropped along the way. The pongs answering these pings are not
+	// forwarded. Zero means no pings.
+	WebsocketPingInterval time.Duration
 }
 
-func (p *Proxy) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+// newSession returns a context carrying a new session id.
+func (p *Proxy) newSession() context.Context {
 	p.sessionMutex.Lock()
+	defer p.sessionMutex.Unlock()
 	ctx := context.WithValue(context.Background(), "session", p.session)
 	p.session = p.session + 1
-	p.sessionMutex.Unlock()
+	return ctx
+}
+
+func (p *Proxy) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+	ctx := p.newSession()
+	p.logger().Debugf("[%d] %s %s from %s", ctx.Value("session"), req.Method, req.RequestURI, req.RemoteAddr)
 	// hijack the connection with the client
 	hijacker, ok := wrt.(http.Hijacker)
 
 	if !ok {
-		HttpError(wrt, "Hijacking not supported", http.StatusInternalServerError)
+		http.Error(wrt, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
+	if p.isShuttingDown() {
+		http.Error(wrt, "Proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if wait := p.rateLimited(req.RemoteAddr, requestAddr(req)); wait > 0 {
+		p.logger().Infof("[%d] Too many requests from %s to %s", ctx.Value("session"), req.RemoteAddr, requestAddr(req))
+		tooManyRequests(wrt, wait)
+		return
+	}
+
+	if !acquire(&p.counters.activeConnections, p.MaxConcurrentConnections) {
+		p.logger().Infof("[%d] Too many connections, refusing %s", ctx.Value("session"), req.RemoteAddr)
+		wrt.Header().Set("Connection", "close")
+		http.Error(wrt, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(&p.counters.activeConnections, -1)
+
 	//Bleah: Needed for HTTPS
-	//And what about HTTP2?
 	// this is the connection with the client
 	clientConn, _, err := hijacker.Hijack()
-	defer clientConn.Close()
-
 	if err != nil {
-		HttpError(wrt, err.Error(), http.StatusInternalServerError)
+		http.Error(wrt, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	clientConn, closeConn := p.trackConn(ctx, clientConn)
+	defer closeConn()
+	// the deadlines set by the server must not apply to tunnels
+	clientConn.SetDeadline(time.Time{})
+
+	if !p.addConn(clientConn) {
+		HttpError(clientConn, "Proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.removeConn(clientConn)
+
+	clientConn = &countingConn{Conn: clientConn, read: &p.counters.bytesReceived, written: &p.counters.bytesSent}
+
+	if !p.authenticate(req) {
+		p.logger().Infof("[%d] Proxy authentication failed from %s", ctx.Value("session"), req.RemoteAddr)
+		proxyAuthRequired(clientConn)
 		return
 	}
 
 	if req.Method != http.MethodConnect {
 		// this is a plaintext HTTP connection
-		reqClone := req.Clone(context.TODO())
+		destinationHost, err := plainTarget(req)
 		if err != nil {
-			HttpError(wrt, err.Error(), http.StatusInternalServerError)
+			HttpError(clientConn, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// an origin-form target is made absolute like the other ones
+		setDestination(req, destinationHost)
+		if isCAHost(req.URL.Host) {
+			p.serveCA(clientConn, req)
+			return
+		}
+		if p.forbidHost(clientConn, req.URL.Host) {
+			return
+		}
+		var reqClone *http.Request
+		ctx, reqClone = p.scopeRequest(ctx, req, destinationHost)
+		if isWebSocketRequest(req) {
+			// a ws:// websocket, the upgrade cannot go through the client
+			p.serveWebsocket(ctx, req, clientConn, false)
 			return
 		}
+		expectContinue(req, clientConn)
 
 		// Forward the request to the remote host
-		// RequestURI will contain the Request Target
-		// https://datatracker.ietf.org/doc/html/rfc7230#section-5.3.2
-		resp, err := p.forwardReq(ctx, req, req.RequestURI)
+		resp, err := p.forwardReq(ctx, req, destinationHost)
 
+		if errors.Is(err, ErrConnectionReset) {
+			p.logger().Infof("[%d] Connection with %s reset by HandleRequest", ctx.Value("session"), req.RemoteAddr)
+			resetConn(clientConn)
+			return
+		}
 		if err != nil {
-			HttpError(wrt, err.Error(), http.StatusInternalServerError)
+			HttpError(clientConn, err.Error(), errorStatus(err, http.StatusInternalServerError))
 			return
 		}
 
+		defer resp.Body.Close()
+
 		// forward the response back to the client
-		error := p.forwardResp(ctx, resp, clientConn, reqClone)
-		if error != nil {
-			HttpError(clientConn, error.Error(), http.StatusInternalServerError)
+		if err := p.forwardResp(ctx, resp, clientConn, reqClone); err != nil {
+			p.logger().Errorf("[%d] Error sending the response: %v", ctx.Value("session"), err)
 			return
 		}
 
 	} else {
 		// Some usefull documentation
 		// https://datatracker.ietf.org/doc/html/rfc2817#section-5.2
-		// For being compliant with the RFC, the proxy should first
-		// perform a dial to the remote destination host and *then* send
-		// a 200OK to the client. However, I have no idea how to do this
-		// while leveraging the convinience of Transport provided by Go.
-		// So for know, I will knowingly violate the RFC.
+		// For being compliant with the RFC, the proxy first performs a
+		// dial to the remote destination host and *then* sends a 200OK
+		// to the client.
+
+		target, err := connectTarget(req)
+		if err != nil {
+			HttpError(clientConn, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.forbidHost(clientConn, target) {
+			return
+		}
+		switch action := p.connectAction(ctx, target); action.Action {
+		case ConnectReject:
+			rejectConnect(clientConn, action)
+			return
+		case ConnectTunnel:
+			p.tunnel(ctx, clientConn, target)
+			return
+		}
+		if hostMatchesAny(p.TLSPassthroughHosts, target) {
+			p.tunnel(ctx, clientConn, target)
+			return
+		}
+		if p.TunnelOnHandshakeFailure && p.isFailedHost(target) {
+			p.tunnel(ctx, clientConn, target)
+			return
+		}
+
+		upstreamConn, err := p.dialUpstream(context.Background(), target)
+		if err != nil {
+			HttpError(clientConn, err.Error(), errorStatus(err, http.StatusBadGateway))
+			return
+		}
 
-		// Save the destinationHost along with the scheme.
-		destinationHost := fmt.Sprintf("https://%s", req.RequestURI)
+		p.logger().Debugf("[%d] Connected to %s", ctx.Value("session"), target)
 
 		// Answer with a 200OK to the client.
 		clientConn.Write([]byte(okHeader))
 
-		// check if destination speaks TLS
-		conf := &tls.Config{
-			InsecureSkipVerify: true,
+		// whatever the port, look at what the client sends to know what
+		// to do with the connection.
+		clientConn, protocol, err := sniffClient(clientConn)
+		if err != nil {
+			upstreamConn.Close()
+			return
 		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		d := tls.Dialer{
-			Config: conf,
+		switch protocol {
+		case protocolHTTP:
+			upstreamConn.Close()
+			// e.g. a plaintext websocket connection
+			p.serveRequests(ctx, clientConn, "http://"+target, nil)
+			return
+		case protocolUnknown:
+			// e.g. SSH, relay it as it is
+			p.logger().Debugf("[%d] Tunneling connection to %s", ctx.Value("session"), target)
+			p.relay(ctx, target, clientConn, upstreamConn)
+			return
 		}
-		_, err := d.DialContext(ctx, "tcp", req.RequestURI)
-		cancel() // why am I calling the cancel function?
+
+		// check if destination speaks TLS too
+		probeConn, reusable, err := p.probeTLS(upstreamConn, target)
 		if err != nil {
-			//defer conn.Close()
-			// not a TLS connection, go with raw tcp for now
-			// I'm assuming that if I cannot establish a TLS connection with
-			// the remote server maybe this is a plaintext websocket connection
-			clientTlsReader := bufio.NewReader(clientConn)
-			req, err := http.ReadRequest(clientTlsReader)
-			if err != nil {
-				log.Println("Not an HTTP request")
-				return
-			}
-			if isWebSocketRequest(req) {
-				p.serveWebsocket(wrt, req, clientConn, false)
-			}
+			upstreamConn.Close()
+			// the connection has been used by the probe, open a new one
+			p.replayTunnel(ctx, clientConn, target, nil)
 
 		} else {
 			// a TLS connection
 
-			// Start a TLS connection with the client.
-			clientConn = p.startTlsWithClient(clientConn)
-			defer clientConn.Close()
-
-			clientTlsReader := bufio.NewReader(clientConn)
-			for !isEob(clientTlsReader) {
-
-				reqClone := req.Clone(context.TODO())
-				if err != nil {
-					HttpError(wrt, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				req, err := http.ReadRequest(clientTlsReader)
-				if err != nil {
-					// Assume this is a HTTPS connection
-					//clientConnTls = p.startTlsWithClient(clientConn)
-					log.Println("Not an HTTP request")
-					return
-				} else {
-
-					if isWebSocketRequest(req) {
-						p.serveWebsocket(wrt, req, clientConn, true)
-					}
-				}
-
-				resp, err := p.forwardReq(ctx, req, destinationHost)
-				if err != nil {
-					HttpError(clientConn, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				// Do I need to have a write buffer for the connection with the client??
-				error := p.forwardResp(ctx, resp, clientConn, reqClone)
-				if error != nil {
-					HttpError(clientConn, error.Error(), http.StatusInternalServerError)
-					return
-				}
+			// keep the certificate and the TLS version of the real server
+			upstreamState := probeConn.ConnectionState()
+			if reusable {
+				// the transport will use this connection for the first
+				// request instead of dialing again.
+				p.putUpstreamConn(target, probeConn)
+				defer p.dropUpstreamConn(target, probeConn)
+			} else {
+				probeConn.Close()
+			}
+
+			p.serveTLS(ctx, clientConn, target, &upstreamState, false)
+		}
+	}
+}
+
+// serveTLS starts a TLS connection with the client and serves the requests
+// it sends to host. upstream is the state of the TLS connection with the
+// real server, if known. In transparent mode the destination is taken from the SNI of the
+// client, if any, rather than host which is the original IP address.
+func (p *Proxy) serveTLS(ctx context.Context, clientConn net.Conn, host string, upstream *tls.ConnectionState, transparent bool) {
+	// Start a TLS connection with the client.
+	clientTlsConn, clientHello, err := p.startTlsWithClient(clientConn, host, upstream)
+	if errors.Is(err, errTLSPassthrough) && clientHello != nil {
+		p.logger().Debugf("[%d] Tunneling TLS connection to %s, a passthrough host", ctx.Value("session"), host)
+		p.replayTunnel(ctx, clientConn, host, clientHello)
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&p.counters.tlsHandshakeFailures, 1)
+		p.logger().Errorf("Server Handshake error: %v", err)
+		if p.TunnelOnHandshakeFailure {
+			if clientHello != nil {
+				// the client is still waiting for the handshake
+				p.replayTunnel(ctx, clientConn, host, clientHello)
+			} else {
+				// the client refused the certificate, do not try again
+				p.addFailedHost(host)
+			}
+		}
+		return
+	}
+	defer clientTlsConn.Close()
+	state := clientTlsConn.ConnectionState()
+	p.logger().Debugf("[%d] TLS handshake with the client completed, protocol %q", ctx.Value("session"), state.NegotiatedProtocol)
+
+	// Save the destinationHost along with the scheme.
+	destinationHost := (&url.URL{Scheme: "https", Host: host}).String()
+	if transparent && state.ServerName != "" {
+		_, port, _ := net.SplitHostPort(host)
+		destinationHost = (&url.URL{Scheme: "https", Host: net.JoinHostPort(state.ServerName, port)}).String()
+		if !p.hostAllowed(state.ServerName) {
+			p.logger().Infof("Connection to %s forbidden", state.ServerName)
+			return
+		}
+	}
+
+	if state.NegotiatedProtocol == http2.NextProtoTLS {
+		p.serveHTTP2(clientTlsConn, destinationHost, &state)
+		return
+	}
+	if state.NegotiatedProtocol == "http/1.1" {
+		p.serveRequests(ctx, clientTlsConn, destinationHost, &state)
+		return
+	}
+	// clients not using ALPN might not speak HTTP at all
+	sniffed, protocol, err := sniffClient(clientTlsConn)
+	if err != nil {
+		return
+	}
+	if protocol != protocolHTTP {
+		// not HTTP over TLS, e.g. IMAPS
+		p.tlsTunnel(ctx, sniffed, strings.TrimPrefix(destinationHost, "https://"), state.NegotiatedProtocol)
+		return
+	}
+	p.serveRequests(ctx, sniffed, destinationHost, &state)
+}
+
+// serveRequests reads the requests sent by the client and forwards them to
+// destinationHost, until the client closes the connection or asks to.
+// Request bodies, chunked or not, are read from the connection as they are
+// forwarded, only the body handlers buffer them.
+// Every request has its own session. clientTLS is the state of the TLS
+// connection with the client, nil if it is not encrypted.
+func (p *Proxy) serveRequests(ctx context.Context, clientConn net.Conn, destinationHost string, clientTLS *tls.ConnectionState) {
+	clientTlsReader := bufio.NewReader(clientConn)
+	addr := destinationAddr(destinationHost)
+	for !isEob(clientTlsReader) {
+		req, err := http.ReadRequest(clientTlsReader)
+		if err != nil {
+			p.logger().Errorf("Not an HTTP request: %v", err)
+			return
+		}
+		req.RemoteAddr = clientConn.RemoteAddr().String()
+		req.TLS = clientTLS
+		if wait := p.rateLimited(req.RemoteAddr, addr); wait > 0 {
+			p.logger().Infof("[%d] Too many requests from %s to %s", ctx.Value("session"), req.RemoteAddr, addr)
+			keepAlive := !req.Close && discardBody(req.Body)
+			writeTooManyRequests(clientConn, wait, !keepAlive)
+			if !keepAlive {
+				return
+			}
+			ctx = p.newSession()
+			continue
+		}
+		var reqClone *http.Request
+		ctx, reqClone = p.scopeRequest(ctx, req, destinationHost)
+		if isWebSocketRequest(req) {
+			p.serveWebsocket(ctx, req, clientConn, clientTLS != nil)
+			return
+		}
+		continueBody := expectContinue(req, clientConn)
+
+		resp, err := p.forwardReq(ctx, req, destinationHost)
+		if errors.Is(err, ErrConnectionReset) {
+			p.logger().Infof("[%d] Connection with %s reset by HandleRequest", ctx.Value("session"), req.RemoteAddr)
+			resetConn(clientConn)
+			return
+		}
+		if err != nil {
+			// the error only concerns this request, the next one can
+			// be read once the body of this one has been.
+			keepAlive := !req.Close && !errors.Is(err, ErrProxyClosed) &&
+				(continueBody == nil || continueBody.continued()) && discardBody(req.Body)
+			writeError(clientConn, err.Error(), errorStatus(err, http.StatusInternalServerError), !keepAlive)
+			if !keepAlive {
 				return
 			}
+			ctx = p.newSession()
+			continue
+		}
+		// the connection with the client is kept open unless it asked
+		// otherwise, whatever the remote host answered. When the client
+		// has not been told to send the body it is not known whether it
+		// will, so the connection is closed.
+		resp.Close = req.Close || continueBody != nil && !continueBody.continued()
+		err = p.forwardResp(ctx, resp, clientConn, reqClone)
+		resp.Body.Close()
+		if err != nil {
+			p.logger().Errorf("[%d] Error sending the response: %v", ctx.Value("session"), err)
 			return
 		}
+		if resp.Close || !hasLength(resp) {
+			return
+		}
+		// the body is not read when HandleRequest answers by itself
+		if !discardBody(req.Body) {
+			// the next request cannot be found
+			return
+		}
+		ctx = p.newSession()
 	}
 }
 
 // Takes the client request, eventually modifies it and sends it to the intended destination host
 func (p *Proxy) forwardReq(ctx context.Context, clientRequest *http.Request, destinationHost string) (*http.Response, error) {
 
-	if p.HandleRequest != nil {
-		// call to HandleRequest
-		hResp := p.HandleRequest(ctx.Value("session").(int64), clientRequest)
+	atomic.AddInt64(&p.counters.requests, 1)
+	if !acquire(&p.counters.activeRequests, p.MaxConcurrentRequests) {
+		atomic.AddInt64(&p.counters.errors, 1)
+		return nil, ErrTooManyRequests
+	}
+	resp, err := p.doForwardReq(ctx, clientRequest, destinationHost)
+	if err != nil || resp.Body == nil {
+		atomic.AddInt64(&p.counters.activeRequests, -1)
+	} else {
+		// the request is over once its response has been sent
+		var once sync.Once
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() {
+			once.Do(func() { atomic.AddInt64(&p.counters.activeRequests, -1) })
+		}}
+	}
+	if err != nil {
+		atomic.AddInt64(&p.counters.errors, 1)
+	}
+	return resp, err
+}
+
+// setDestination makes the URL of req absolute, with the scheme and the
+// host of destinationHost, so that the handlers always see an absolute URL
+// whether the request was tunneled or not.
+func setDestination(req *http.Request, destinationHost string) error {
+	u, err := url.Parse(destinationHost)
+	if err != nil {
+		return err
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	return nil
+}
+
+// rewriteTarget makes req go to target, a host with an optional port or
+// an absolute URL whose scheme and host are used. The Host header follows
+// unless preserveHost is set.
+func rewriteTarget(req *http.Request, target string, preserveHost bool) error {
+	u := &url.URL{Scheme: req.URL.Scheme, Host: target}
+	if strings.Contains(target, "://") {
+		var err error
+		if u, err = url.Parse(target); err != nil {
+			return err
+		}
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	if !preserveHost {
+		// the transport takes it from the URL
+		req.Host = ""
+	}
+	return nil
+}
+
+func (p *Proxy) doForwardReq(ctx context.Context, clientRequest *http.Request, destinationHost string) (*http.Response, error) {
+	if err := setDestination(clientRequest, destinationHost); err != nil {
+		return nil, err
+	}
+	if err := p.limitRequestBody(clientRequest); err != nil {
+		return nil, err
+	}
+	// the handlers may replace the request
+	remoteAddr := clientRequest.RemoteAddr
+	clientRequest, timing := withTiming(clientRequest)
+	var err error
+
+	if inScope(ctx) {
+		var hResp *http.Response
+		clientRequest, hResp, err = p.handleReq(ctx, clientRequest)
+		if err != nil {
+			return nil, err
+		}
 		if hResp != nil {
+			timing.Response = time.Now()
 			return hResp, nil
 		}
 	}
 
-	clientRequest.RequestURI = ""
-
-	u, err := url.Parse(destinationHost)
+	// the request is sent as a copy prepared for the remote host, the one
+	// seen by the handlers is left as they left it.
+	reqCtx, cancel := p.requestContext(clientRequest)
+	outRequest := clientRequest.Clone(reqCtx)
+	outRequest.RequestURI = ""
+	// the values of the trailers are only known once the body has been
+	// read, the copy must see them
+	outRequest.Trailer = clientRequest.Trailer
+	if p.RewriteTarget != nil {
+		if target := p.RewriteTarget(ctx.Value("session").(int64), clientRequest); target != "" {
+			if err := rewriteTarget(outRequest, target, p.PreserveHost); err != nil {
+				cancel()
+				return nil, err
+			}
+			// the filters apply to the new target as well
+			if !p.hostAllowed(outRequest.URL.Host) {
+				cancel()
+				return nil, fmt.Errorf("%s: %w", outRequest.URL.Host, ErrHostNotAllowed)
+			}
+			p.logger().Debugf("[%d] Sending %s to %s", ctx.Value("session"), clientRequest.URL, outRequest.URL.Host)
+		}
+	}
+	removeHopByHopHeaders(outRequest.Header)
+	if acceptsTrailers(clientRequest.Header) {
+		// e.g. gRPC, the trailers of the response are relayed
+		outRequest.Header.Set("Te", "trailers")
+	}
+	p.setRequestID(ctx, outRequest.Header)
+	if p.ForwardedHeaders {
+		addForwardedHeaders(outRequest.Header, remoteAddr, clientRequest.URL.Scheme)
+	}
+	p.setUpstreamProxyAuth(outRequest)
+	if proxyURL := p.upstreamProxy(outRequest); proxyURL != nil && p.BlockPrivateNetworks {
+		// the upstream proxy connects to the remote host, not the proxy
+		if err := p.checkPublic(ctx, outRequest.URL.Host); err != nil {
+			cancel()
+			return nil, err
+		}
+		outRequest = outRequest.WithContext(context.WithValue(outRequest.Context(), upstreamProxyKey{}, proxyAddr(proxyURL)))
+	}
+	p.logger().Debugf("[%d] Forwarding %s %s", ctx.Value("session"), outRequest.Method, outRequest.URL)
+	host := websocketAddr(outRequest.URL.Host, outRequest.URL.Scheme == "https")
+	if err := p.CircuitBreaker.allow(host); err != nil {
+		cancel()
+		return nil, err
+	}
+	session := ctx.Value("session").(int64)
+	p.dumpRequest(session, outRequest)
+	timing.Sent = time.Now()
+	resp, err := p.doRequest(ctx, outRequest)
+	timing.Response = time.Now()
+	p.reportCircuit(host, err)
+	resp, err = p.checkUpstreamProxyAuth(outRequest, resp, err)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
+	p.dumpResponse(session, resp)
+	// a pointer, so that the handlers replacing the body can be told
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	if inScope(ctx) {
+		p.handleUpstreamTLS(ctx, resp.TLS)
+	}
+	return resp, nil
+}
+
+// handleUpstreamTLS gives the state of the TLS connection with the remote
+// host to HandleUpstreamTLS.
+func (p *Proxy) handleUpstreamTLS(ctx context.Context, state *tls.ConnectionState) {
+	if p.HandleUpstreamTLS != nil && state != nil {
+		p.HandleUpstreamTLS(ctx.Value("session").(int64), *state)
+	}
+}
 
-	clientRequest.URL.Scheme = u.Scheme
-	clientRequest.URL.Host = u.Host
-	return p.HttpClient.Do(clientRequest)
+// handleReq runs the request handlers and returns the request to forward,
+// or the response returned by HandleRequest.
+func (p *Proxy) handleReq(ctx context.Context, req *http.Request) (*http.Request, *http.Response, error) {
+	session := ctx.Value("session").(int64)
+	if p.HandleRequest != nil {
+		if hResp := p.HandleRequest(session, req); hResp != nil {
+			if hResp == DropResponse {
+				return nil, nil, ErrConnectionReset
+			}
+			if hResp.Request == nil {
+				hResp.Request = req
+			}
+			return req, hResp, nil
+		}
+	}
+	if p.ModifyRequestHeaders != nil {
+		p.ModifyRequestHeaders(session, req)
+	}
+	p.applyRequestRules(req)
+	req, err := p.interceptRequest(session, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.handleRequestBody(session, req); err != nil {
+		return nil, nil, err
+	}
+	return req, nil, nil
 }
 
+// forwardResp runs the response handlers and sends resp to the client.
+// The client gets a 502 if the response cannot be read from the remote
+// host, any other error means that the response has been partially written
+// and that the connection with the client must be closed.
 func (p *Proxy) forwardResp(ctx context.Context, resp *http.Response, down io.Writer, req *http.Request) error {
+	if err := p.handleResp(ctx, resp, req); err != nil {
+		HttpError(down, err.Error(), errorStatus(err, http.StatusBadGateway))
+		return err
+	}
+	removeHopByHopHeaders(resp.Header)
+	p.setRequestID(ctx, resp.Header)
+	p.logger().Debugf("[%d] Sending response %s", ctx.Value("session"), resp.Status)
+	// resp.Write makes a write for every line of the headers and for every
+	// chunk of the body, buffer them to save syscalls. The buffer is
+	// flushed before waiting for the next part of the body so that
+	// streamed responses still reach the client right away.
+	bw := bufio.NewWriter(down)
+	if resp.Body != nil {
+		resp.Body = flushingBody{ReadCloser: resp.Body, w: bw}
+	}
+	// bufio.Writer.ReadFrom reads the body straight into its buffer,
+	// which must not be flushed in the meantime.
+	err := resp.Write(writerOnly{bw})
+	if flushErr := bw.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// writerOnly hides the io.ReaderFrom implementation of a writer.
+type writerOnly struct {
+	io.Writer
+}
+
+// flushingBody flushes w before reading more of the body.
+type flushingBody struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (b flushingBody) Read(p []byte) (int, error) {
+	if b.w.Buffered() > 0 {
+		if err := b.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// handleResp runs the response handlers.
+func (p *Proxy) handleResp(ctx context.Context, resp *http.Response, req *http.Request) error {
+	p.counters.addResponse(resp.StatusCode)
+	if !inScope(ctx) {
+		return nil
+	}
+	if err := p.decodeResponseBody(resp); err != nil {
+		return err
+	}
+	body := resp.Body
 	if p.HandleResponse != nil {
 		p.HandleResponse(ctx.Value("session").(int64), req, resp)
 	}
-	return resp.Write(down)
+	if p.StripHSTS {
+		resp.Header.Del("Strict-Transport-Security")
+	}
+	if p.ModifyResponseHeaders != nil {
+		p.ModifyResponseHeaders(ctx.Value("session").(int64), resp)
+	}
+	if resp.Request != nil {
+		p.applyHeaderRules(RuleResponse, resp.Request.URL.Host, resp.Header)
+	}
+	// the body of a response that is not held is the same, even when it
+	// is too large to be intercepted
+	changed := !sameBody(resp.Body, body)
+	held, err := p.interceptResponse(ctx.Value("session").(int64), req, resp)
+	if err != nil {
+		return err
+	}
+	streaming := p.isStreaming(ctx.Value("session").(int64), resp)
+	if changed || held {
+		// the length of the new body is not known
+		if err := p.fixResponseLength(resp, body, streaming); err != nil {
+			return err
+		}
+	}
+	if streaming {
+		return nil
+	}
+	return p.handleResponseBody(ctx.Value("session").(int64), resp)
 }
 
+// HttpError writes to conn an HTTP/1.1 response with the status code and
+// the message er, and asks the client to close the connection.
 func HttpError(conn io.Writer, er string, code int) {
+	writeError(conn, er, code, true)
+}
+
+// writeError writes an error response like HttpError, close tells whether
+// the client must close the connection.
+func writeError(conn io.Writer, er string, code int, close bool) {
+	errorResponse(er, code, close).Write(conn)
+}
+
+// errorResponse returns the response written by writeError.
+func errorResponse(er string, code int, close bool) *http.Response {
 	rsp := &http.Response{
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		StatusCode: code,
-		Header:     make(map[string][]string),
-		Body:       io.NopCloser(bytes.NewBufferString(er)),
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    code,
+		Header:        make(map[string][]string),
+		Body:          io.NopCloser(bytes.NewBufferString(er)),
+		ContentLength: int64(len(er)),
+		Close:         close,
 	}
 	rsp.Header.Add("Content-Type", "text/plain; charset=utf-8")
 	rsp.Header.Add("X-Content-Type-Options", "nosniff")
-	rsp.Write(conn)
+	return rsp
 }
 
-func NewProxy() *Proxy {
-	p := &Proxy{}
-	certs = make(map[string]*tls.Certificate)
-	// By default skip TLS verification
-	p.Tr = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// NewResponse returns a response with the given status code, headers and
+// body. Returned by HandleRequest, it is sent to the client without
+// contacting the remote host.
+func NewResponse(statusCode int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: int64(len(body)),
+	}
+	if len(body) > 0 {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
 	}
+	return resp
+}
+
+// DropResponse, returned by HandleRequest, makes the proxy neither forward
+// the request nor answer it: the connection with the client is reset with
+// a TCP RST, without a TLS close_notify for the CONNECT tunnels, so the
+// other requests sent on it are lost too. Over HTTP/2 only the stream of
+// the request is reset. It is meant to simulate failures or to block
+// clients hard.
+var DropResponse = &http.Response{}
+
+// ErrConnectionReset is returned when HandleRequest returns DropResponse.
+var ErrConnectionReset = errors.New("connection reset by the proxy")
+
+// NewProxy returns a proxy with the default settings, changed by opts.
+func NewProxy(opts ...Option) *Proxy {
+	p := &Proxy{}
+	p.certCache = make(map[string]*tls.Certificate)
+	p.Tr = p.newTransport()
 	// By default:
 	// - do not follow redirection;
-	// - set a 10 seconds timeout
+	// - set a 10 seconds timeout, see RequestTimeout
 	cl := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 		Transport: p.Tr,
-		Timeout:   time.Second * 10}
+	}
 	p.HttpClient = cl
+	p.RequestTimeout = DefaultRequestTimeout
 	if p.CaCert == nil || p.CaKey == nil {
 		p.CaCert = caCert
 		p.CaKey = caKey
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
 	return p
 }
 
+// dialContext opens a connection with a remote host using Dialer if set,
+// or a net.Dialer with DialTimeout otherwise.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the upstream proxy is not checked, the destination has been
+	if proxyAddr, _ := ctx.Value(upstreamProxyKey{}).(string); proxyAddr == addr {
+		return p.dial(ctx, network, addr)
+	}
+	if p.BlockPrivateNetworks {
+		return p.dialPublic(ctx, network, addr)
+	}
+	return p.dial(ctx, network, addr)
+}
+
+func (p *Proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p.Dialer != nil {
+		return p.Dialer(network, addr)
+	}
+	d := net.Dialer{Timeout: p.DialTimeout}
+	return d.DialContext(ctx, network, addr)
+}
+
 // startTlsWithClient starts a TLS connection with the client.
-func (p *Proxy) startTlsWithClient(down net.Conn) net.Conn {
+// Both h2 and http/1.1 are offered to the client via ALPN, unless
+// ClientTLSConfig says otherwise.
+// host is the destination the client connected to, used when the client
+// does not send SNI. upstream is the state of the TLS connection with the
+// real server, if known.
+// If the handshake fails because the proxy could not provide a certificate
+// and TunnelOnHandshakeFailure is set, the bytes received from the client
+// are returned so that the connection can be tunneled to the real server.
+func (p *Proxy) startTlsWithClient(down net.Conn, host string, upstream *tls.ConnectionState) (*tls.Conn, []byte, error) {
+	hsConn := &handshakeConn{Conn: down, recording: p.TunnelOnHandshakeFailure || len(p.TLSPassthroughHosts) > 0}
+	if host == "" && down.LocalAddr() != nil {
+		// without SNI the certificate is for the address the client
+		// connected to, i.e. the proxy itself.
+		host = down.LocalAddr().String()
+	}
 
 	tlfConf := new(tls.Config)
+	if p.ClientTLSConfig != nil {
+		tlfConf = p.ClientTLSConfig.Clone()
+		tlfConf.Certificates = nil
+		tlfConf.GetConfigForClient = nil
+	}
+	if len(tlfConf.NextProtos) == 0 {
+		tlfConf.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	var upstreamCert *x509.Certificate
+	if upstream != nil && len(upstream.PeerCertificates) > 0 {
+		upstreamCert = upstream.PeerCertificates[0]
+	}
+	if p.MirrorUpstream && upstream != nil {
+		mirrorVersion(tlfConf, upstream.Version)
+	}
 	// https://pkg.go.dev/crypto/tls#Config
 	// GetCertificate returns a Certificate based on the given
 	// ClientHelloInfo. It will only be called if the client supplies SNI
 	// information or if Certificates is empty.
 	tlfConf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		// get CA key pair
-		CA, err := tls.X509KeyPair(p.CaCert, p.CaKey)
-		if err != nil {
-			log.Fatalf("Cannot parse provided CA key pair %s\n", err)
+		if hello.ServerName != "" && hostMatchesAny(p.TLSPassthroughHosts, hello.ServerName) {
+			// the connection is tunneled, the client must not notice
+			hsConn.muted = true
+			return nil, errTLSPassthrough
 		}
-		// get CA certificate
-		CA.Leaf, err = x509.ParseCertificate(CA.Certificate[0])
-		if err != nil {
-			log.Fatalf("Cannot parse CA certificate: %s\n", err)
+		signer, err := p.signer()
+		if err == nil {
+			var cert *tls.Certificate
+			if cert, err = p.getCert(signer, certHost(hello.ServerName, host), upstreamCert); err == nil {
+				return cert, nil
+			}
 		}
-		return getCert(CA, hello.ServerName)
+		// nothing has been sent to the client yet, so do not send
+		// the alert and leave the chance to tunnel the connection.
+		hsConn.muted = p.TunnelOnHandshakeFailure
+		return nil, err
 	}
 
 	// perform a TLS connection with the client.
-	c := tls.Server(down, tlfConf)
+	c := tls.Server(hsConn, tlfConf)
 	if err := c.Handshake(); err != nil {
-		log.Printf("Server Handshake error: %v\n", err)
+		if hsConn.muted {
+			return nil, hsConn.recorded.Bytes(), err
+		}
+		return nil, nil, err
+	}
+	hsConn.stopRecording()
+	return c, nil, nil
+}
+
+// hasLength tells whether the client can find the end of the body of resp,
+// otherwise the connection has to be closed after the body.
+func hasLength(resp *http.Response) bool {
+	if resp.ContentLength != -1 {
+		return true
+	}
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCertHost is the name of the certificate for the clients that send
+// no SNI when the host they connected to is not known either.
+const defaultCertHost = "localhost"
+
+// certHost returns the name the certificate for the client is generated
+// for: the SNI sent by the client or, if missing, the host it connected to.
+func certHost(serverName, host string) string {
+	if serverName != "" {
+		return serverName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// an IPv6 literal without port
+	if host = strings.Trim(host, "[]"); host == "" {
+		return defaultCertHost
+	}
+	return host
+}
+
+// hostPort returns host with defaultPort if it does not have a port. IPv6
+// literals are bracketed, e.g. [::1]:443.
+func hostPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
 	}
-	return c
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
 }
 
 // isEob check is there's something else to read from the buffer.